@@ -7,11 +7,13 @@ import (
 	"kestoeso/pkg/parser"
 	"kestoeso/pkg/provider"
 	"os"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -27,20 +29,62 @@ provide ESO SecretStores and ExternalSecrets definitions.
 	Examples:
 		kes-to-eso generate -i path/to/kes/files -o eso/output/dir --to-stdout=false
 		kes-to-eso generate -i path/to/a/single.yaml --kes-namespace=my_custom_namespace
-		kes-to-eso generate -i path/to/kes/files | kubectl apply -f -`,
+		kes-to-eso generate -i path/to/kes/files | kubectl apply -f -
+		kes-to-eso generate --from-cluster --source-namespace=my-app -l team=payments -o eso/output/dir
+		kes-to-eso generate -i path/to/kes/files --store-name-template='{{ .Namespace }}-{{ .Backend }}-{{ .Hash }}'
+		kes-to-eso generate -i path/to/kes/files -o eso/output/dir --report=report.json
+		kes-to-eso generate -i path/to/kes/files -o eso/output/dir --eso-api-version=v1
+		kes-to-eso generate -i path/to/kes/files -o eso/output/dir --output-layout=kustomize
+		kes-to-eso generate -i path/to/kes/files -o eso/output/chart --output-layout=helm --helm-chart-name=my-secrets
+		kes-to-eso generate -i path/to/kes/files -o eso/output/dir --kes-helm-values=kes/values.yaml`,
 	Run: func(cmd *cobra.Command, args []string) {
 		log.SetOutput(os.Stderr)
 		opt := apis.NewOptions()
 		opt.ContainerName, _ = cmd.Flags().GetString("kes-container-name")
 		opt.DeploymentName, _ = cmd.Flags().GetString("kes-deployment-name")
 		opt.Namespace, _ = cmd.Flags().GetString("kes-namespace")
+		opt.DetectKES, _ = cmd.Flags().GetBool("detect-kes")
 		opt.SecretStore, _ = cmd.Flags().GetBool("secret-store")
 		opt.ToStdout, _ = cmd.Flags().GetBool("to-stdout")
 		opt.InputPath, _ = cmd.Flags().GetString("input")
 		opt.TargetNamespace, _ = cmd.Flags().GetString("target-namespace")
 		opt.CopySecretRefs, _ = cmd.Flags().GetBool("copy-secret-refs") // TODO - IMPLEMENT THIS
-		_, err := os.Stat(opt.InputPath)
+		opt.FromCluster, _ = cmd.Flags().GetBool("from-cluster")
+		opt.SourceNamespace, _ = cmd.Flags().GetString("source-namespace")
+		opt.LabelSelector, _ = cmd.Flags().GetString("selector")
+		opt.NamespaceFileNames, _ = cmd.Flags().GetBool("namespace-file-names")
+		opt.StoreNameTemplate, _ = cmd.Flags().GetString("store-name-template")
+		opt.ReuseOutputStores, _ = cmd.Flags().GetBool("reuse-output-stores")
+		opt.ReuseClusterStores, _ = cmd.Flags().GetBool("reuse-cluster-stores")
+		reportPath, _ := cmd.Flags().GetString("report")
+		opt.ESOAPIVersion, _ = cmd.Flags().GetString("eso-api-version")
+		opt.OutputLayout, _ = cmd.Flags().GetString("output-layout")
+		opt.StoresComponent, _ = cmd.Flags().GetBool("kustomize-stores-component")
+		opt.HelmChartName, _ = cmd.Flags().GetString("helm-chart-name")
+		opt.HelmCredentialValues, _ = cmd.Flags().GetBool("helm-credential-values")
+		opt.DeploymentFile, _ = cmd.Flags().GetString("kes-deployment-file")
+		opt.HelmValuesFile, _ = cmd.Flags().GetString("kes-helm-values")
+		opt.Workers, _ = cmd.Flags().GetInt("workers")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		if opt.DeploymentFile != "" && opt.HelmValuesFile != "" {
+			fmt.Println("Use either --kes-deployment-file or --kes-helm-values")
+			os.Exit(1)
+		}
+		if !isOutputLayout(opt.OutputLayout) {
+			fmt.Printf("Invalid output layout %v, use one of %v\n", opt.OutputLayout, strings.Join(apis.OutputLayouts, ", "))
+			os.Exit(1)
+		}
+		if !parser.IsESOAPIVersion(opt.ESOAPIVersion) {
+			fmt.Printf("Invalid ESO API version %v, use one of %v\n", opt.ESOAPIVersion, strings.Join(apis.ESOAPIVersions, ", "))
+			os.Exit(1)
+		}
+		err := parser.ValidateStoreNameTemplate(opt.StoreNameTemplate)
 		if err != nil {
+			fmt.Printf("Invalid store name template: %v\n", err)
+			os.Exit(1)
+		}
+		_, err = os.Stat(opt.InputPath)
+		if err != nil && !opt.FromCluster {
 			fmt.Println("Missing input path!")
 			err := cmd.Help()
 			if err != nil {
@@ -78,21 +122,48 @@ provide ESO SecretStores and ExternalSecrets definitions.
 		if opt.SecretStore && !opt.CopySecretRefs {
 			log.Warnf("Warning! Backend Secret References are not being copied to the secret store namespaces! This could lead to unintended behavior (--secret-store=true --copy-secret-refs=false)")
 		}
-		config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-		if err != nil {
-			log.Fatal(err)
+		client := provider.KesToEsoClient{
+			Options: opt,
+		}
+		if opt.DeploymentFile != "" {
+			client.KES, err = provider.ReadKESDeploymentFile(opt.DeploymentFile, opt)
+		} else if opt.HelmValuesFile != "" {
+			client.KES, err = provider.ReadKESHelmValues(opt.HelmValuesFile, opt)
 		}
-		clientset, err := kubernetes.NewForConfig(config)
 		if err != nil {
 			log.Fatal(err)
 		}
-		client := provider.KesToEsoClient{
-			Client:  clientset,
-			Options: opt,
+		// KES manifests stand for the cluster: nothing is read from it, not
+		// even the objects missing from the manifests, unless the KES
+		// ExternalSecrets themselves come from the cluster.
+		if client.KES != nil && !opt.FromCluster {
+			log.Infof("Reading KES credentials from the given manifests only, without cluster access")
+			opt.ReuseClusterStores = false
+		} else {
+			config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+			clientset, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				log.Fatal(err)
+			}
+			dynamicClient, err := dynamic.NewForConfig(config)
+			if err != nil {
+				log.Fatal(err)
+			}
+			client.Client = clientset
+			client.DynamicClient = dynamicClient
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
-		parser.Root(ctx, &client)
+		_, rep := parser.Root(ctx, &client)
+		if reportPath != "" {
+			err = rep.Write(reportPath)
+			if err != nil {
+				log.Fatalf("Could not write report: %v", err)
+			}
+		}
 		os.Exit(0)
 
 	},
@@ -105,5 +176,32 @@ func init() {
 	generateCmd.Flags().String("kes-deployment-name", "kubernetes-external-secrets", "name of KES deployment object")
 	generateCmd.Flags().String("kes-container-name", "kubernetes-external-secrets", "name of KES container object")
 	generateCmd.Flags().StringP("kes-namespace", "n", "default", "namespace where KES is installed")
+	generateCmd.Flags().Bool("detect-kes", true, "when the KES deployment is not found, look for Deployments and StatefulSets running the KES image or having the KES chart labels")
+	generateCmd.Flags().Bool("from-cluster", false, "read KES ExternalSecrets from the cluster instead of --input")
+	generateCmd.Flags().String("source-namespace", "", "namespace to read KES ExternalSecrets from with --from-cluster (defaults to all namespaces)")
+	generateCmd.Flags().StringP("selector", "l", "", "label selector to filter KES ExternalSecrets read with --from-cluster")
+	generateCmd.Flags().Bool("namespace-file-names", false, "name output files external-secret-<namespace>-<name>.yaml instead of external-secret-<name>.yaml, so ExternalSecrets sharing a name in several namespaces don't overwrite each other")
+	generateCmd.Flags().String("store-name-template", parser.DefaultStoreNameTemplate, "Go template naming generated stores, using .Backend, .Kind, .Namespace, .Controller and .Hash (a hash of the store content)")
+	generateCmd.Flags().Bool("reuse-output-stores", true, "reuse SecretStores already written to --output by earlier runs instead of generating duplicates")
+	generateCmd.Flags().Bool("reuse-cluster-stores", true, "reuse SecretStores and ClusterSecretStores already applied to the cluster instead of generating duplicates")
+	generateCmd.Flags().String("eso-api-version", apis.ESOAPIVersionV1alpha1, "external-secrets.io API version of the generated objects: "+strings.Join(apis.ESOAPIVersions, ", "))
+	generateCmd.Flags().String("output-layout", apis.OutputLayoutFlat, "layout of --output: flat writes every file in it, kustomize writes a kustomize base with a directory per namespace and a stores directory, helm writes a chart reading namespaces, store names, store auth and refresh intervals from its values")
+	generateCmd.Flags().Bool("kustomize-stores-component", false, "with --output-layout=kustomize, write the stores directory as a kustomize component")
+	generateCmd.Flags().String("helm-chart-name", "external-secrets-migration", "with --output-layout=helm, name of the chart")
+	generateCmd.Flags().Bool("helm-credential-values", false, "with --output-layout=helm, copy the static credentials found in KES into values.yaml in plain text instead of leaving their Secrets out of the chart")
+	generateCmd.Flags().String("kes-deployment-file", "", "read KES credentials from this Deployment manifest, which may also hold its ServiceAccount and Secrets, instead of the cluster")
+	generateCmd.Flags().String("kes-helm-values", "", "read KES credentials from this values file of the kubernetes-external-secrets chart instead of the cluster")
+	generateCmd.Flags().Int("workers", 8, "number of KES ExternalSecrets converted concurrently")
+	generateCmd.Flags().Duration("timeout", 10*time.Minute, "maximum duration of the whole conversion")
+	generateCmd.Flags().String("report", "", "write a report of the migration to this file, as JSON if it ends in .json and as YAML otherwise")
 	generateCmd.Flags().String("target-namespace", "", "namespace to install files (not recommended - overrides KES-ExternalSecrets definitions)")
 }
+
+func isOutputLayout(layout string) bool {
+	for _, l := range apis.OutputLayouts {
+		if l == layout {
+			return true
+		}
+	}
+	return false
+}
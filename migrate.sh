@@ -6,7 +6,7 @@ ESO_NAMESPACE="es"
 ## can be done with:
 mkdir -p kes_files
 mkdir -p eso_files
-bash -c "$(kubectl get externalsecrets.kubernetes-client.io -A -o=jsonpath='{range .items[*]}{"kubectl get externalsecrets.kubernetes-client.io -o yaml -n "}{.metadata.namespace}{" "}{.metadata.name}{" >> kes_files/"}{.metadata.namespace}{"-"}{.metadata.name}{".yaml; "}{end}')"
+kubectl get externalsecrets.kubernetes-client.io -A -o yaml > kes_files/externalsecrets.yaml
 
 #Step 1 Scale ESO to 0 (safeguard, really)
 kubectl scale deployment -n $ESO_NAMESPACE external-secrets --replicas=0
@@ -1,6 +1,7 @@
 package apis
 
 import (
+	esmeta "github.com/external-secrets/external-secrets/apis/meta/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -9,24 +10,36 @@ type KESExternalSecretData struct {
 	Name         string
 	SecretType   string `json:"secretType"`
 	Property     string
-	Recursive    string
+	Recursive    bool `json:"recursive"`
 	Path         string
 	VersionStage string
+	VersionId    string `json:"versionId"`
+	Version      string
+	IsBinary     bool `json:"isBinary"`
+	KeyVaultName string
+	ProjectID    string `json:"projectId"`
+}
+type KESExternalSecretDataFrom struct {
+	Key          string
+	VersionStage string
+	VersionId    string `json:"versionId"`
 	Version      string
 	IsBinary     bool `json:"isBinary"`
 }
 type KESExternalSecretSpec struct {
-	BackendType     string
-	VaultMountPoint string
-	VaultRole       string
-	KvVersion       int
-	KeyVaultName    string
-	ProjectID       string
-	RoleArn         string
-	Region          string
-	DataFrom        []string
-	Data            []KESExternalSecretData
-	Template        map[string]interface{}
+	BackendType         string
+	ControllerId        string `json:"controllerId"`
+	VaultMountPoint     string
+	VaultRole           string
+	KvVersion           int
+	KeyVaultName        string
+	ProjectID           string
+	RoleArn             string
+	Region              string
+	DataFrom            []string
+	DataFromWithOptions []KESExternalSecretDataFrom `json:"dataFromWithOptions"`
+	Data                []KESExternalSecretData
+	Template            map[string]interface{}
 }
 type KESExternalSecret struct {
 	Kind       string            `json:"kind,omitempty"`
@@ -35,29 +48,154 @@ type KESExternalSecret struct {
 	Spec       KESExternalSecretSpec
 }
 
+// ESOFindName mirrors the name matcher of an ESO dataFrom.find entry.
+type ESOFindName struct {
+	RegExp string `json:"regexp"`
+}
+
+// ESOFind mirrors an ESO dataFrom.find entry.
+type ESOFind struct {
+	Path             *string      `json:"path,omitempty"`
+	Name             *ESOFindName `json:"name,omitempty"`
+	DecodingStrategy string       `json:"decodingStrategy,omitempty"`
+}
+
+// ESORewriteRegexp mirrors an ESO dataFrom.rewrite regexp entry.
+type ESORewriteRegexp struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type ESORewrite struct {
+	Regexp *ESORewriteRegexp `json:"regexp,omitempty"`
+}
+
+// ESODataFromRef is a dataFrom entry that the external-secrets.io/v1alpha1
+// types cannot hold, since they only know about plain keys.
+type ESODataFromRef struct {
+	Find    *ESOFind     `json:"find,omitempty"`
+	Rewrite []ESORewrite `json:"rewrite,omitempty"`
+}
+
+// ESOExtensions holds whatever part of a converted ExternalSecret needs an ESO
+// API version newer than v1alpha1. It is merged into the ExternalSecret when
+// the object is rendered.
+type ESOExtensions struct {
+	DataFrom []ESODataFromRef
+	// DecodingStrategy of data entries, by secretKey
+	DecodingStrategy map[string]string
+	// DataFromDecodingStrategy of dataFrom extract entries, by index in dataFrom
+	DataFromDecodingStrategy map[int]string
+	// TemplateEngine the template was translated for
+	TemplateEngine string
+}
+
+func (e ESOExtensions) IsEmpty() bool {
+	return len(e.DataFrom) == 0 && len(e.DecodingStrategy) == 0 && len(e.DataFromDecodingStrategy) == 0
+}
+
+// ESOAkeylessAuthSecretRef mirrors the secretRef of an ESO akeyless provider.
+type ESOAkeylessAuthSecretRef struct {
+	AccessID        esmeta.SecretKeySelector `json:"accessID"`
+	AccessType      esmeta.SecretKeySelector `json:"accessType"`
+	AccessTypeParam esmeta.SecretKeySelector `json:"accessTypeParam"`
+}
+
+type ESOAkeylessAuth struct {
+	SecretRef ESOAkeylessAuthSecretRef `json:"secretRef"`
+}
+
+// ESOAkeylessProvider mirrors the akeyless provider of an ESO SecretStore.
+type ESOAkeylessProvider struct {
+	AkeylessGWApiURL *string          `json:"akeylessGWApiURL"`
+	Auth             *ESOAkeylessAuth `json:"authSecretRef"`
+}
+
+// ESOStoreExtensions holds the providers of a converted SecretStore that
+// external-secrets.io/v1alpha1 doesn't know about. The SecretStore is then
+// rendered with the newer API version.
+type ESOStoreExtensions struct {
+	Akeyless *ESOAkeylessProvider
+}
+
+func (e ESOStoreExtensions) IsEmpty() bool {
+	return e.Akeyless == nil
+}
+
 type KesToEsoOptions struct {
-	Namespace       string
-	DeploymentName  string
-	ContainerName   string
-	InputPath       string
-	OutputPath      string
-	ToStdout        bool
-	SecretStore     bool
-	TargetNamespace string
-	CopySecretRefs  bool
+	Namespace            string
+	DeploymentName       string
+	ContainerName        string
+	WorkloadKind         string // kind of the KES workload, Deployment or StatefulSet
+	DetectKES            bool   // look for KES when DeploymentName is not found
+	InputPath            string
+	OutputPath           string
+	ToStdout             bool
+	SecretStore          bool
+	TargetNamespace      string
+	CopySecretRefs       bool
+	FromCluster          bool
+	SourceNamespace      string
+	LabelSelector        string
+	NamespaceFileNames   bool // name output files after namespace and name
+	StoreNameTemplate    string
+	ReuseOutputStores    bool
+	ReuseClusterStores   bool
+	ESOAPIVersion        string
+	OutputLayout         string
+	StoresComponent      bool // write stores/ as a kustomize component
+	HelmChartName        string
+	HelmCredentialValues bool   // copy static credentials into the helm chart values
+	DeploymentFile       string // KES Deployment manifest read instead of the cluster
+	HelmValuesFile       string // KES chart values read instead of the cluster
+	Workers              int    // documents converted concurrently
 }
 
+// Layouts of the output directory.
+const (
+	OutputLayoutFlat      = "flat"
+	OutputLayoutKustomize = "kustomize"
+	OutputLayoutHelm      = "helm"
+)
+
+var OutputLayouts = []string{OutputLayoutFlat, OutputLayoutKustomize, OutputLayoutHelm}
+
+// ESO API versions generated objects can be written for.
+const (
+	ESOAPIVersionV1alpha1 = "v1alpha1"
+	ESOAPIVersionV1beta1  = "v1beta1"
+	ESOAPIVersionV1       = "v1"
+)
+
+var ESOAPIVersions = []string{ESOAPIVersionV1alpha1, ESOAPIVersionV1beta1, ESOAPIVersionV1}
+
 func NewOptions() *KesToEsoOptions {
 	t := KesToEsoOptions{
-		Namespace:       "default",
-		DeploymentName:  "kubernetes-external-secrets",
-		ContainerName:   "kubernetes-external-secrets",
-		InputPath:       "",
-		OutputPath:      "",
-		ToStdout:        false,
-		SecretStore:     false,
-		TargetNamespace: "",
-		CopySecretRefs:  false,
+		Namespace:            "default",
+		DeploymentName:       "kubernetes-external-secrets",
+		ContainerName:        "kubernetes-external-secrets",
+		WorkloadKind:         "Deployment",
+		DetectKES:            true,
+		InputPath:            "",
+		OutputPath:           "",
+		ToStdout:             false,
+		SecretStore:          false,
+		TargetNamespace:      "",
+		CopySecretRefs:       false,
+		FromCluster:          false,
+		SourceNamespace:      "",
+		LabelSelector:        "",
+		StoreNameTemplate:    "",
+		ReuseOutputStores:    true,
+		ReuseClusterStores:   true,
+		ESOAPIVersion:        ESOAPIVersionV1alpha1,
+		OutputLayout:         OutputLayoutFlat,
+		StoresComponent:      false,
+		HelmChartName:        "external-secrets-migration",
+		HelmCredentialValues: false,
+		DeploymentFile:       "",
+		HelmValuesFile:       "",
+		Workers:              8,
 	}
 	return &t
 }
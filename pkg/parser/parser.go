@@ -1,22 +1,33 @@
 package parser
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"kestoeso/pkg/apis"
 	"kestoeso/pkg/provider"
+	"kestoeso/pkg/report"
 	"kestoeso/pkg/utils"
-	"math/rand"
 	"os"
 	"path/filepath"
-	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"text/template"
 
 	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 
 	//	"k8s.io/client-go/util/homedir"
 	//	"k8s.io/client-go/kubernetes"
@@ -26,49 +37,96 @@ import (
 	yaml "sigs.k8s.io/yaml"
 )
 
-// Store DB Functions
-
-type SecretStoreDB []api.SecretStore
-type StoreDB interface {
-	Exists(S api.SecretStore) (bool, int)
+// kesDocument is a single object read from an input file. Index is the
+// position of the object in the file: every item of a List counts on its
+// own and empty documents are ignored.
+type kesDocument struct {
+	Index int
+	Kes   apis.KESExternalSecret
+	Err   error
 }
 
-func (storedb SecretStoreDB) Exists(S api.SecretStore) (bool, int) {
-	for idx, secretStore := range storedb {
-		if S.Kind == "SecretStore" &&
-			secretStore.Namespace == S.Namespace &&
-			secretStore.APIVersion == S.APIVersion &&
-			secretStore.Kind == S.Kind &&
-			reflect.DeepEqual(secretStore.Spec, S.Spec) {
-			return true, idx
-		} else if S.Kind == "ClusterSecretStore" &&
-			secretStore.APIVersion == S.APIVersion &&
-			secretStore.Kind == S.Kind &&
-			reflect.DeepEqual(secretStore.Spec, S.Spec) {
-			return true, idx
+// splitDocuments splits a file into its documents. YAML streams are split
+// on `---` separators and JSON input may hold one or more concatenated objects.
+func splitDocuments(dat []byte) ([][]byte, error) {
+	docs := make([][]byte, 0)
+	if utilyaml.IsJSONBuffer(dat) {
+		decoder := json.NewDecoder(bytes.NewReader(dat))
+		for {
+			var doc json.RawMessage
+			err := decoder.Decode(&doc)
+			if err == io.EOF {
+				return docs, nil
+			}
+			if err != nil {
+				return docs, err
+			}
+			docs = append(docs, doc)
+		}
+	}
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(dat)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			return docs, nil
 		}
+		if err != nil {
+			return docs, err
+		}
+		docs = append(docs, doc)
 	}
-	return false, -1
 }
 
-var ESOSecretStoreList = make(SecretStoreDB, 0)
-
-//
+// listItems returns the items of a `kind: List` (or any typed *List, such as
+// the output of `kubectl get externalsecrets -o yaml`) document.
+func listItems(content map[string]interface{}) ([]interface{}, bool) {
+	kind, _ := content["kind"].(string)
+	if !strings.HasSuffix(kind, "List") {
+		return nil, false
+	}
+	items, ok := content["items"].([]interface{})
+	return items, ok
+}
 
-func readKESFromFile(file string) (apis.KESExternalSecret, error) {
+func readKESFromFile(file string) ([]kesDocument, error) {
 	dat, err := os.ReadFile(file)
 	if err != nil {
-		return apis.KESExternalSecret{}, err
+		return nil, err
 	}
-	var K = apis.KESExternalSecret{}
-	err = yaml.Unmarshal(dat, &K)
+	raw, err := splitDocuments(dat)
 	if err != nil {
-		return apis.KESExternalSecret{}, err
+		return nil, err
 	}
-	return K, nil
+	ans := make([]kesDocument, 0, len(raw))
+	for _, doc := range raw {
+		var content map[string]interface{}
+		err = yaml.Unmarshal(doc, &content)
+		if err == nil && len(content) == 0 {
+			continue
+		}
+		if items, ok := listItems(content); ok {
+			for _, item := range items {
+				K := apis.KESExternalSecret{}
+				dat, err := json.Marshal(item)
+				if err == nil {
+					err = json.Unmarshal(dat, &K)
+				}
+				ans = append(ans, kesDocument{Index: len(ans), Kes: K, Err: err})
+			}
+			continue
+		}
+		K := apis.KESExternalSecret{}
+		if err == nil {
+			err = yaml.Unmarshal(doc, &K)
+		}
+		ans = append(ans, kesDocument{Index: len(ans), Kes: K, Err: err})
+	}
+	return ans, nil
 }
 
-//TODO: Allow future versions here
+// NewESOSecret returns an empty ExternalSecret. ExternalSecrets are modelled
+// on external-secrets.io/v1alpha1 while converting, renderExternalSecret
+// writes them for the ESO API version asked for.
 func NewESOSecret() api.ExternalSecret {
 	d := api.ExternalSecret{}
 	d.TypeMeta = metav1.TypeMeta{
@@ -78,45 +136,168 @@ func NewESOSecret() api.ExternalSecret {
 	return d
 }
 
-var letters = []rune("abcdefghijklmnopqrstuvwxyz")
-
-func randSeq(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+// mapLoop returns the template keys that have no ESO equivalent.
+func mapLoop(m map[string]interface{}) []string {
+	ans := make([]string, 0)
+	for k := range m {
+		if k != "metadata" && k != "type" && k != "data" && k != "stringData" {
+			ans = append(ans, k)
+		}
 	}
-	return string(b)
+	sort.Strings(ans)
+	return ans
 }
 
-func mapLoop(m map[string]interface{}) error {
-	for k := range m {
-		if k != "metadata" && k != "type" && k != "data" {
-			return fmt.Errorf("%v templating is currently not supported", k)
+func canMigrateKes(K apis.KESExternalSecret) error {
+	for _, data := range K.Spec.Data {
+		if data.Path != "" && K.Spec.BackendType != "systemManager" {
+			return errors.New("externalSecret with path selection is only supported for systemManager")
 		}
 	}
 	return nil
 }
 
-func canMigrateKes(K apis.KESExternalSecret) error {
-	err := mapLoop(K.Spec.Template)
+// VaultStoreKey is everything that tells Vault stores apart: KES objects
+// with the same key are served by the same store.
+type VaultStoreKey struct {
+	Server    string
+	AuthMount string
+	Role      string
+	KVMount   string
+	KVVersion api.VaultKVStoreVersion
+}
+
+func isVaultStore(S api.SecretStore) bool {
+	return S.Spec.Provider != nil && S.Spec.Provider.Vault != nil
+}
+
+func vaultStoreKey(S api.SecretStore) VaultStoreKey {
+	v := S.Spec.Provider.Vault
+	key := VaultStoreKey{
+		Server:    v.Server,
+		KVMount:   v.Path,
+		KVVersion: v.Version,
+	}
+	if v.Auth.Kubernetes != nil {
+		key.AuthMount = v.Auth.Kubernetes.Path
+		key.Role = v.Auth.Kubernetes.Role
+	}
+	return key
+}
+
+func (k VaultStoreKey) String() string {
+	return fmt.Sprintf("server=%v auth-mount=%v role=%v kv-mount=%v kv-version=%v", k.Server, k.AuthMount, k.Role, k.KVMount, k.KVVersion)
+}
+
+// DefaultStoreNameTemplate names stores after their backend and the hash of
+// their content.
+const DefaultStoreNameTemplate = "{{ .Backend }}-secretstore-autogen-{{ .Hash }}"
+
+// StoreNameData is what a store naming template can use.
+type StoreNameData struct {
+	Backend    string // lowercased KES backend type
+	Kind       string // SecretStore or ClusterSecretStore
+	Namespace  string
+	Controller string
+	Hash       string // hash of the store content
+}
+
+// storeHash hashes everything that makes a store, so the same stores get the
+// same names on every run. ClusterSecretStores don't depend on a namespace,
+// and Vault stores only on their VaultStoreKey.
+func storeHash(S api.SecretStore, ext apis.ESOStoreExtensions) (string, error) {
+	content := struct {
+		Kind      string
+		Namespace string
+		Spec      api.SecretStoreSpec
+		Vault     *VaultStoreKey `json:",omitempty"`
+		Ext       apis.ESOStoreExtensions
+	}{
+		Kind: S.Kind,
+		Spec: S.Spec,
+		Ext:  ext,
+	}
+	if S.Kind == "SecretStore" {
+		content.Namespace = S.ObjectMeta.Namespace
+	}
+	if isVaultStore(S) {
+		key := vaultStoreKey(S)
+		content.Vault = &key
+		content.Spec = api.SecretStoreSpec{Controller: S.Spec.Controller}
+	}
+	dat, err := json.Marshal(content)
 	if err != nil {
-		return err
+		return "", err
 	}
-	for _, data := range K.Spec.Data {
-		if data.Path != "" {
-			return errors.New("externalSecret with path selection is currently not supported")
-		}
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])[:8], nil
+}
+
+// storeName renders the naming template, or DefaultStoreNameTemplate when
+// none is given, for a store of the given backend.
+func storeName(S api.SecretStore, ext apis.ESOStoreExtensions, backend string, nameTemplate string) (string, error) {
+	if nameTemplate == "" {
+		nameTemplate = DefaultStoreNameTemplate
 	}
-	return nil
+	tpl, err := template.New("store-name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+	hash, err := storeHash(S, ext)
+	if err != nil {
+		return "", err
+	}
+	data := StoreNameData{
+		Backend:    strings.ToLower(backend),
+		Kind:       S.Kind,
+		Namespace:  S.ObjectMeta.Namespace,
+		Controller: S.Spec.Controller,
+		Hash:       hash,
+	}
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	name := buf.String()
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("store name %q is not valid: %v", name, strings.Join(errs, ", "))
+	}
+	return name, nil
 }
 
-func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecret, client *provider.KesToEsoClient) (api.SecretStore, bool) {
+// ValidateStoreNameTemplate checks that a naming template renders a valid
+// store name.
+func ValidateStoreNameTemplate(nameTemplate string) error {
+	S := utils.NewSecretStore(false)
+	S.ObjectMeta.Namespace = "default"
+	_, err := storeName(S, apis.ESOStoreExtensions{}, "vault", nameTemplate)
+	return err
+}
+
+// bindProvider fills the provider of S for K and binds K to an equal store,
+// which is created when none is known yet.
+func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecret, client *provider.KesToEsoClient, stores StoreDB, rep *report.Log) (api.SecretStore, apis.ESOStoreExtensions, bool) {
+	S, ext, ok := fillProvider(ctx, S, K, client, rep)
+	if !ok {
+		return S, ext, false
+	}
+	return bindStore(S, ext, K, client, stores, rep)
+}
+
+// fillProvider fills the provider of S for K, reading its credentials from
+// the KES deployment. ok is false when no store can be built for K.
+func fillProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecret, client *provider.KesToEsoClient, rep *report.Log) (api.SecretStore, apis.ESOStoreExtensions, bool) {
 	if client.Options.TargetNamespace != "" {
 		S.ObjectMeta.Namespace = client.Options.TargetNamespace
 	} else {
 		S.ObjectMeta.Namespace = K.ObjectMeta.Namespace
 	}
+	// ESO instances started with a matching --controller-class keep the
+	// partitioning of KES instances
+	S.Spec.Controller = K.Spec.ControllerId
 	var err error
+	ext := apis.ESOStoreExtensions{}
 	backend := K.Spec.BackendType
 	switch backend {
 	case "secretsManager":
@@ -129,7 +310,9 @@ func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecr
 		S.Spec.Provider = &prov
 		S, err = client.InstallAWSSecrets(ctx, S)
 		if err != nil {
-			log.Warnf("Failed to Install AWS Backend Specific configuration: %v. Make sure you have set up Controller Pod Identity or manually edit SecretStore before applying it", err)
+			rep.Warnf(report.CodeProviderCredentials, "Failed to Install AWS Backend Specific configuration: %v. Make sure you have set up Controller Pod Identity or manually edit SecretStore before applying it", err)
+		} else {
+			warnAWSPodRole(ctx, S, client, rep)
 		}
 	case "systemManager":
 		p := api.AWSProvider{}
@@ -141,7 +324,9 @@ func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecr
 		S.Spec.Provider = &prov
 		S, err = client.InstallAWSSecrets(ctx, S)
 		if err != nil {
-			log.Warnf("Failed to Install AWS Backend Specific configuration: %v. Make sure you have set up Controller Pod Identity Manually Edit SecretStore before applying it", err)
+			rep.Warnf(report.CodeProviderCredentials, "Failed to Install AWS Backend Specific configuration: %v. Make sure you have set up Controller Pod Identity Manually Edit SecretStore before applying it", err)
+		} else {
+			warnAWSPodRole(ctx, S, client, rep)
 		}
 	case "azureKeyVault": // TODO RECHECK MAPPING ON REAL USE CASE. WHAT KEYVAULTNAME IS USED FOR?
 		p := api.AzureKVProvider{}
@@ -152,7 +337,7 @@ func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecr
 		S.Spec.Provider.AzureKV.VaultURL = &vaultUrl
 		S, err = client.InstallAzureKVSecrets(ctx, S)
 		if err != nil {
-			log.Warnf("Failed to Install Azure Backend Specific configuration: %v. Manually Edit SecretStore before applying it", err)
+			rep.Warnf(report.CodeProviderCredentials, "Failed to Install Azure Backend Specific configuration: %v. Manually Edit SecretStore before applying it", err)
 		}
 	case "gcpSecretsManager":
 		p := api.GCPSMProvider{}
@@ -162,7 +347,7 @@ func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecr
 		S.Spec.Provider = &prov
 		S, err = client.InstallGCPSMSecrets(ctx, S)
 		if err != nil {
-			log.Warnf("Failed to Install GCP Backend Specific configuration: %v. Makesure you have set up workload identity or manually edit SecretStore before applying it", err)
+			rep.Warnf(report.CodeProviderCredentials, "Failed to Install GCP Backend Specific configuration: %v. Makesure you have set up workload identity or manually edit SecretStore before applying it", err)
 		}
 	case "ibmcloudSecretsManager":
 		prov := api.SecretStoreProvider{}
@@ -170,7 +355,7 @@ func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecr
 		S.Spec.Provider = &prov
 		S, err = client.InstallIBMSecrets(ctx, S)
 		if err != nil {
-			log.Warnf("Failed to Install IBM Backend Specific configuration: %v. Manually Edit SecretStore before applying it", err)
+			rep.Warnf(report.CodeProviderCredentials, "Failed to Install IBM Backend Specific configuration: %v. Manually Edit SecretStore before applying it", err)
 		}
 	case "vault": // TODO RECHECK MAPPING ON REAL USE CASE
 		p := api.VaultProvider{}
@@ -178,9 +363,10 @@ func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecr
 			p.Version = api.VaultKVStoreV1
 		} else {
 			p.Version = api.VaultKVStoreV2
-			p.Path = getVaultProviderPath(K.Spec.Data, K.Spec.DataFrom)
-			if p.Path == "" {
-				return S, false
+			// parseSpecifics fails documents with several mounts
+			p.Path, err = getVaultProviderPath(K.Spec.Data, dataFromKeys(K))
+			if err != nil || p.Path == "" {
+				return S, ext, false
 			}
 		}
 		prov := api.SecretStoreProvider{}
@@ -188,7 +374,7 @@ func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecr
 		S.Spec.Provider = &prov
 		S, err = client.InstallVaultSecrets(ctx, S)
 		if err != nil {
-			log.Warnf("Failed to Install Vault Backend Specific configuration: %v. Manually Edit SecretStore before applying it", err)
+			rep.Warnf(report.CodeProviderCredentials, "Failed to Install Vault Backend Specific configuration: %v. Manually Edit SecretStore before applying it", err)
 			kubeauth := api.VaultKubernetesAuth{}
 			S.Spec.Provider.Vault.Auth.Kubernetes = &kubeauth
 		}
@@ -198,40 +384,90 @@ func bindProvider(ctx context.Context, S api.SecretStore, K apis.KESExternalSecr
 		if K.Spec.VaultRole != "" {
 			S.Spec.Provider.Vault.Auth.Kubernetes.Role = K.Spec.VaultRole
 		}
+	case "alicloudSecretsManager":
+		prov := api.SecretStoreProvider{}
+		prov.Alibaba = &api.AlibabaProvider{}
+		S.Spec.Provider = &prov
+		S, err = client.InstallAlicloudSecrets(ctx, S)
+		if err != nil {
+			rep.Warnf(report.CodeProviderCredentials, "Failed to Install Alicloud Backend Specific configuration: %v. Manually Edit SecretStore before applying it", err)
+		}
+		if !isV1alpha1(client.Options.ESOAPIVersion) && S.Spec.Provider.Alibaba.Endpoint != "" {
+			rep.Skipf(report.CodeFieldDropped, "alibaba.endpoint", "external-secrets.io/%v has no alibaba endpoint, dropping %v. ESO picks the endpoint of region %v", client.Options.ESOAPIVersion, S.Spec.Provider.Alibaba.Endpoint, S.Spec.Provider.Alibaba.RegionID)
+			S.Spec.Provider.Alibaba.Endpoint = ""
+		}
+	case "akeyless":
+		S.Spec.Provider = &api.SecretStoreProvider{}
+		ext.Akeyless = &apis.ESOAkeylessProvider{}
+		ext, err = client.InstallAkeylessSecrets(ctx, ext)
+		if err != nil {
+			rep.Warnf(report.CodeProviderCredentials, "Failed to Install Akeyless Backend Specific configuration: %v. Manually Edit SecretStore before applying it", err)
+		}
 	default:
-		log.Warnf("Provider %v is not currently supported!", backend)
+		rep.Warnf(report.CodeUnsupportedBackend, "Provider %v is not currently supported!", backend)
+		return S, ext, false
 	}
-	exists, pos := ESOSecretStoreList.Exists(S)
-	if !exists {
-		S.ObjectMeta.Name = fmt.Sprintf("%v-secretstore-autogen-%v", strings.ToLower(backend), randSeq(8))
-		ESOSecretStoreList = append(ESOSecretStoreList, S)
-		return S, true
-	} else {
-		return ESOSecretStoreList[pos], false
+	return S, ext, true
+}
+
+// warnAWSPodRole tells which annotation ESO pods need when S reads with the
+// kube2iam or kiam role of the KES pods.
+func warnAWSPodRole(ctx context.Context, S api.SecretStore, client *provider.KesToEsoClient, rep *report.Log) {
+	auth := S.Spec.Provider.AWS.Auth
+	if auth.SecretRef != nil || auth.JWTAuth != nil {
+		return
 	}
+	role := client.AWSPodRole(ctx)
+	if role == "" {
+		return
+	}
+	msg := fmt.Sprintf("KES reads AWS with the kube2iam/kiam role %v of its pods. Add the pod annotation %v: %v to the ESO controller (podAnnotations of the external-secrets chart) so that %v keeps the same identity", role, provider.AWSPodRoleAnnotation, role, S.Spec.Provider.AWS.Service)
+	if S.Spec.Provider.AWS.Role == "" {
+		msg += ". The role is not an ARN, set spec.provider.aws.role by hand if ESO must assume it"
+	}
+	rep.Warnf(report.CodeAWSPodRole, "%v", msg)
 }
 
-func getVaultProviderPath(data []apis.KESExternalSecretData, dataFrom []string) string {
-	prefix := ""
+// bindStore names S and binds K to it, or to an equal store already known.
+func bindStore(S api.SecretStore, ext apis.ESOStoreExtensions, K apis.KESExternalSecret, client *provider.KesToEsoClient, stores StoreDB, rep *report.Log) (api.SecretStore, apis.ESOStoreExtensions, bool) {
+	backend := K.Spec.BackendType
+	user := fmt.Sprintf("%v/%v", K.ObjectMeta.Namespace, K.ObjectMeta.Name)
+	var err error
+	S.ObjectMeta.Name, err = storeName(S, ext, backend, client.Options.StoreNameTemplate)
+	if err != nil {
+		rep.Warnf(report.CodeStoreNameTemplate, "Could not name %v store with the naming template: %v. Using the default name", backend, err)
+		S.ObjectMeta.Name, _ = storeName(S, ext, backend, DefaultStoreNameTemplate)
+	}
+	entry, created := stores.Bind(S, ext, user)
+	if created && entry.Store.ObjectMeta.Name != S.ObjectMeta.Name {
+		rep.Warnf(report.CodeStoreNameTaken, "Store name %v is already taken, using %v instead", S.ObjectMeta.Name, entry.Store.ObjectMeta.Name)
+	}
+	if created {
+		reportNearMatches(stores, entry, rep)
+	} else if entry.Source != "" {
+		log.Infof("Reusing %v %v, loaded from %v, for %v", entry.Store.Kind, entry.Store.ObjectMeta.Name, entry.Source, user)
+	}
+	return entry.Store, entry.Ext, created
+}
+
+// getVaultProviderPath returns the KV mount every key of a Vault KV v2
+// ExternalSecret reads from, which becomes the path of its store.
+func getVaultProviderPath(data []apis.KESExternalSecretData, dataFrom []string) (string, error) {
+	keys := make([]string, 0, len(data)+len(dataFrom))
 	for _, d := range data {
-		if prefix == "" {
-			prefix = strings.Split(d.Key, "/")[0]
-		}
-		if prefix != strings.Split(d.Key, "/")[0] {
-			log.Fatal("Failed to parse secret store for KES secret!")
-			return ""
-		}
+		keys = append(keys, d.Key)
 	}
-	for _, d := range dataFrom {
+	keys = append(keys, dataFrom...)
+	prefix := ""
+	for _, key := range keys {
 		if prefix == "" {
-			prefix = strings.Split(d, "/")[0]
+			prefix = strings.Split(key, "/")[0]
 		}
-		if prefix != strings.Split(d, "/")[0] {
-			log.Fatal("Failed to parse secret store for KES secret!")
-			return ""
+		if prefix != strings.Split(key, "/")[0] {
+			return "", fmt.Errorf("keys read from several KV mounts, %v and %v, a Vault SecretStore has a single one", prefix, strings.Split(key, "/")[0])
 		}
 	}
-	return prefix
+	return prefix, nil
 }
 
 func parseSpecifics(K apis.KESExternalSecret, E api.ExternalSecret) (api.ExternalSecret, error) {
@@ -239,10 +475,16 @@ func parseSpecifics(K apis.KESExternalSecret, E api.ExternalSecret) (api.Externa
 	ans := E
 	switch backend {
 	case "vault":
+		if K.Spec.KvVersion != 1 {
+			_, err := getVaultProviderPath(K.Spec.Data, dataFromKeys(K))
+			if err != nil {
+				return E, err
+			}
+		}
 		if K.Spec.KvVersion == 2 {
 			for idx, data := range ans.Spec.Data {
 				paths := strings.Split(data.RemoteRef.Key, "/")
-				if paths[1] != "data" { // we have the good format like <vaultname>/data/<path>/<to>/<secret>
+				if len(paths) < 2 || paths[1] != "data" { // we have the good format like <vaultname>/data/<path>/<to>/<secret>
 					return E, errors.New("secret key not compatible with kv2 format (<vault>/data/<path>/<to>/<secret>)")
 				}
 				str := strings.Join(paths[2:], "/")
@@ -256,7 +498,7 @@ func parseSpecifics(K apis.KESExternalSecret, E api.ExternalSecret) (api.Externa
 		}
 		for idx, dataFrom := range ans.Spec.DataFrom {
 			paths := strings.Split(dataFrom.Key, "/")
-			if paths[1] != "data" { // we have the good format like <vaultname>/data/<path>/<to>/<secret>
+			if len(paths) < 2 || paths[1] != "data" { // we have the good format like <vaultname>/data/<path>/<to>/<secret>
 				return E, errors.New("secret key not compatible with kv2 format (<vault>/data/<path>/<to>/<secret>)")
 			}
 			str := strings.Join(paths[2:], "/")
@@ -268,7 +510,7 @@ func parseSpecifics(K apis.KESExternalSecret, E api.ExternalSecret) (api.Externa
 	return ans, nil
 }
 
-func parseGenerals(K apis.KESExternalSecret, E api.ExternalSecret, options *apis.KesToEsoOptions) (api.ExternalSecret, error) {
+func parseGenerals(K apis.KESExternalSecret, E api.ExternalSecret, options *apis.KesToEsoOptions, rep *report.Log) (api.ExternalSecret, error) {
 	secret := E
 	secret.ObjectMeta.Name = K.ObjectMeta.Name
 	secret.Spec.Target.Name = K.ObjectMeta.Name // Inherits default in KES, so we should do the same approach here
@@ -279,6 +521,9 @@ func parseGenerals(K apis.KESExternalSecret, E api.ExternalSecret, options *apis
 	}
 	var refKey string
 	for _, kesSecretData := range K.Spec.Data {
+		if kesSecretData.Path != "" { // handled by parsePaths
+			continue
+		}
 		if kesSecretData.SecretType != "" {
 			refKey = kesSecretData.SecretType + "/" + kesSecretData.Key
 		} else {
@@ -287,7 +532,7 @@ func parseGenerals(K apis.KESExternalSecret, E api.ExternalSecret, options *apis
 		esoRemoteRef := api.ExternalSecretDataRemoteRef{
 			Key:      refKey,
 			Property: kesSecretData.Property,
-			Version:  kesSecretData.Version}
+			Version:  parseVersion(K, kesSecretData, rep)}
 		esoSecretData := api.ExternalSecretData{
 			SecretKey: kesSecretData.Name,
 			RemoteRef: esoRemoteRef}
@@ -299,33 +544,481 @@ func parseGenerals(K apis.KESExternalSecret, E api.ExternalSecret, options *apis
 		}
 		secret.Spec.DataFrom = append(secret.Spec.DataFrom, esoDataFrom)
 	}
-	templ, err := fillTemplate(secret.Spec.Target.Template, K.Spec.Template)
+	for _, kesSecretDataFrom := range K.Spec.DataFromWithOptions {
+		data := dataFromOptions(kesSecretDataFrom)
+		// newer versions decode through a decodingStrategy, see dataFromDecodingStrategies
+		if data.IsBinary && !rawBinaryBackends[K.Spec.BackendType] && isV1alpha1(options.ESOAPIVersion) {
+			return secret, fmt.Errorf("isBinary on dataFromWithOptions %v can't be expressed by external-secrets.io/v1alpha1 dataFrom, use --eso-api-version=v1beta1 or v1", data.Key)
+		}
+		esoDataFrom := api.ExternalSecretDataRemoteRef{
+			Key:     data.Key,
+			Version: parseVersion(K, data, rep),
+		}
+		secret.Spec.DataFrom = append(secret.Spec.DataFrom, esoDataFrom)
+	}
+	engine := templateEngine(options.ESOAPIVersion)
+	templ, err := fillTemplate(secret.Spec.Target.Template, K.Spec.Template, engine, rep)
 	if err != nil {
 		return secret, err
 	}
+	if isV1alpha1(options.ESOAPIVersion) {
+		// newer versions decode through a decodingStrategy, see decodingStrategies
+		err = decodeBinaries(K, &templ, engine, rep)
+		if err != nil {
+			return secret, err
+		}
+	}
 	secret.Spec.Target.Template = &templ
 	return secret, nil
 
 }
 
-func fillTemplate(template *api.ExternalSecretTemplate, m map[string]interface{}) (api.ExternalSecretTemplate, error) {
+// dataFromOptions reads a dataFromWithOptions entry as a data entry named
+// after its key, so versions are mapped the same way.
+func dataFromOptions(d apis.KESExternalSecretDataFrom) apis.KESExternalSecretData {
+	return apis.KESExternalSecretData{
+		Key:          d.Key,
+		Name:         d.Key,
+		VersionStage: d.VersionStage,
+		VersionId:    d.VersionId,
+		Version:      d.Version,
+		IsBinary:     d.IsBinary,
+	}
+}
+
+// dataFromKeys lists the keys of both dataFrom and dataFromWithOptions.
+func dataFromKeys(K apis.KESExternalSecret) []string {
+	ans := append([]string{}, K.Spec.DataFrom...)
+	for _, d := range K.Spec.DataFromWithOptions {
+		ans = append(ans, d.Key)
+	}
+	return ans
+}
+
+// parseVersion maps the version of a KES data entry onto an ESO remote ref
+// version. For secretsManager ESO reads the version as a stage, or as a
+// version id when it is prefixed with "uuid/".
+func parseVersion(K apis.KESExternalSecret, data apis.KESExternalSecretData, rep *report.Log) string {
+	if K.Spec.BackendType != "secretsManager" {
+		if data.VersionStage != "" || data.VersionId != "" {
+			rep.Skipf(report.CodeVersionIgnored, fmt.Sprintf("data.%v.versionStage", data.Name), "%v/%v: versionStage and versionId are only supported for secretsManager, ignoring them on %v", K.ObjectMeta.Namespace, K.ObjectMeta.Name, data.Name)
+		}
+		return data.Version
+	}
+	if data.Version != "" {
+		rep.Skipf(report.CodeVersionIgnored, fmt.Sprintf("data.%v.version", data.Name), "%v/%v: version is not supported for secretsManager, ignoring it on %v. Use versionStage or versionId instead", K.ObjectMeta.Namespace, K.ObjectMeta.Name, data.Name)
+	}
+	if data.VersionId != "" {
+		if data.VersionStage != "" {
+			rep.Skipf(report.CodeVersionConflict, fmt.Sprintf("data.%v.versionStage", data.Name), "%v/%v: ESO can't select both versionStage %v and versionId %v on %v, using the versionId", K.ObjectMeta.Namespace, K.ObjectMeta.Name, data.VersionStage, data.VersionId, data.Name)
+		}
+		return "uuid/" + data.VersionId
+	}
+	return data.VersionStage
+}
+
+// rawBinaryBackends fetch binary secrets as raw bytes, both in KES and in ESO,
+// so isBinary needs no translation there. Every other backend stores isBinary
+// values as base64 text, which KES copies into the Secret without encoding it
+// again. ESO would encode it again, so those values are decoded by a template.
+var rawBinaryBackends = map[string]bool{
+	"secretsManager":    true, // SecretBinary
+	"gcpSecretsManager": true, // the payload is bytes
+}
+
+var base64BinaryBackends = map[string]bool{
+	"systemManager":          true,
+	"vault":                  true,
+	"azureKeyVault":          true,
+	"ibmcloudSecretsManager": true,
+	"alicloudSecretsManager": true,
+	"akeyless":               true,
+}
+
+// binaryEntries returns the names of the isBinary data entries that ESO
+// would double encode. Values already produced by the KES template are left
+// alone, since the template wins over the fetched data in both. Path entries
+// are decoded by parsePaths.
+func binaryEntries(K apis.KESExternalSecret, templ *api.ExternalSecretTemplate, rep *report.Log) ([]string, error) {
+	ans := make([]string, 0)
+	backend := K.Spec.BackendType
+	for _, kesSecretData := range K.Spec.Data {
+		if !kesSecretData.IsBinary || rawBinaryBackends[backend] || kesSecretData.Path != "" {
+			continue
+		}
+		if !base64BinaryBackends[backend] {
+			return ans, fmt.Errorf("isBinary on %v is not supported for backend %v", kesSecretData.Name, backend)
+		}
+		if templ != nil {
+			if _, ok := templ.Data[kesSecretData.Name]; ok {
+				rep.Warnf(report.CodeBinaryTemplated, "%v/%v: %v is binary and templated, the template receives the base64 encoded value", K.ObjectMeta.Namespace, K.ObjectMeta.Name, kesSecretData.Name)
+				continue
+			}
+		}
+		ans = append(ans, kesSecretData.Name)
+	}
+	return ans, nil
+}
+
+// decodeBinaries adds a template entry decoding each binary entry, as
+// external-secrets.io/v1alpha1 has no decodingStrategy.
+func decodeBinaries(K apis.KESExternalSecret, templ *api.ExternalSecretTemplate, engine string, rep *report.Log) error {
+	names, err := binaryEntries(K, templ, rep)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		decoded, err := base64DecodeTemplate(name, engine)
+		if err != nil {
+			return err
+		}
+		if templ.Data == nil {
+			templ.Data = make(map[string]string)
+		}
+		templ.Data[name] = decoded
+	}
+	return nil
+}
+
+// decodingStrategies returns the decodingStrategy of each binary entry.
+func decodingStrategies(K apis.KESExternalSecret, templ *api.ExternalSecretTemplate, rep *report.Log) (map[string]string, error) {
+	names, err := binaryEntries(K, templ, rep)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	ans := make(map[string]string)
+	for _, name := range names {
+		ans[name] = "Base64"
+	}
+	return ans, nil
+}
+
+// dataFromDecodingStrategies returns the decodingStrategy of each binary
+// dataFromWithOptions entry, by index in the dataFrom of the ExternalSecret,
+// where they follow the plain dataFrom keys.
+func dataFromDecodingStrategies(K apis.KESExternalSecret) (map[int]string, error) {
+	backend := K.Spec.BackendType
+	var ans map[int]string
+	for idx, d := range K.Spec.DataFromWithOptions {
+		if !d.IsBinary || rawBinaryBackends[backend] {
+			continue
+		}
+		if !base64BinaryBackends[backend] {
+			return nil, fmt.Errorf("isBinary on dataFromWithOptions %v is not supported for backend %v", d.Key, backend)
+		}
+		if ans == nil {
+			ans = make(map[int]string)
+		}
+		ans[len(K.Spec.DataFrom)+idx] = "Base64"
+	}
+	return ans, nil
+}
+
+// IsESOAPIVersion tells whether objects can be generated for version.
+func IsESOAPIVersion(version string) bool {
+	for _, known := range apis.ESOAPIVersions {
+		if version == known {
+			return true
+		}
+	}
+	return false
+}
+
+func isV1alpha1(version string) bool {
+	return version == "" || version == apis.ESOAPIVersionV1alpha1
+}
+
+// templateEngine returns the template engine to translate KES templates
+// for. ESO defaults to engine v2 from external-secrets.io/v1beta1 on, and v1
+// only knows about engine v2.
+func templateEngine(version string) string {
+	if isV1alpha1(version) {
+		return templateEngineV1
+	}
+	return templateEngineV2
+}
+
+// storeSplit is the part of a KES ExternalSecret served by a single store.
+// Only the primary split owns the target Secret, the others merge into it.
+type storeSplit struct {
+	Kes     apis.KESExternalSecret
+	Target  string
+	Primary bool
+}
+
+// storeLocation returns the Azure key vault or GCP project a data entry is
+// read from, since KES lets every entry override the one of the spec.
+func storeLocation(K apis.KESExternalSecret, data apis.KESExternalSecretData) string {
+	switch K.Spec.BackendType {
+	case "azureKeyVault":
+		if data.KeyVaultName != "" {
+			return data.KeyVaultName
+		}
+		return K.Spec.KeyVaultName
+	case "gcpSecretsManager":
+		if data.ProjectID != "" {
+			return data.ProjectID
+		}
+		return K.Spec.ProjectID
+	}
+	return ""
+}
+
+// splitByStore splits a KES ExternalSecret reading from several Azure key
+// vaults or GCP projects into one ExternalSecret per vault or project, as an
+// ESO ExternalSecret only reads from a single store. The split that reads
+// from the vault or project of the spec (or the first one) owns the target
+// Secret and the others merge their keys into it.
+func splitByStore(K apis.KESExternalSecret, rep *report.Log) []storeSplit {
+	locations := make([]string, 0)
+	entries := map[string][]apis.KESExternalSecretData{}
+	for _, data := range K.Spec.Data {
+		location := storeLocation(K, data)
+		if _, ok := entries[location]; !ok {
+			locations = append(locations, location)
+		}
+		entries[location] = append(entries[location], data)
+	}
+	spec := storeLocation(K, apis.KESExternalSecretData{})
+	_, specUsed := entries[spec]
+	hasDataFrom := len(K.Spec.DataFrom) > 0 || len(K.Spec.DataFromWithOptions) > 0
+	if hasDataFrom && !specUsed {
+		// dataFrom only reads from the vault or project of the spec
+		locations = append(locations, spec)
+	}
+	if len(locations) < 2 {
+		single := K
+		if len(locations) == 1 {
+			setStoreLocation(&single, locations[0])
+		}
+		return []storeSplit{{Kes: single, Target: K.ObjectMeta.Name, Primary: true}}
+	}
+	primary := locations[0]
+	if specUsed || hasDataFrom {
+		primary = spec
+	}
+	sort.SliceStable(locations, func(i, j int) bool {
+		return locations[i] == primary && locations[j] != primary
+	})
+	names := make([]string, 0, len(locations))
+	ans := make([]storeSplit, 0, len(locations))
+	for _, location := range locations {
+		split := K
+		split.Spec.Data = entries[location]
+		setStoreLocation(&split, location)
+		isPrimary := location == primary
+		if !isPrimary {
+			split.ObjectMeta.Name = fmt.Sprintf("%v-%v", K.ObjectMeta.Name, strings.ToLower(location))
+			split.Spec.DataFrom = nil
+			split.Spec.DataFromWithOptions = nil
+			split.Spec.Template = nil
+		}
+		names = append(names, split.ObjectMeta.Name)
+		ans = append(ans, storeSplit{Kes: split, Target: K.ObjectMeta.Name, Primary: isPrimary})
+	}
+	rep.Warnf(report.CodeStoreSplit, "%v/%v reads from %v %v, splitting it into ExternalSecrets %v. %v owns Secret %v and the others use creationPolicy Merge: the Secret must exist before they sync, and every refresh of %v rewrites it, dropping merged keys until the others refresh again",
+		K.ObjectMeta.Namespace, K.ObjectMeta.Name, storeLocationKind(K), strings.Join(locations, ", "), strings.Join(names, ", "), K.ObjectMeta.Name, K.ObjectMeta.Name, K.ObjectMeta.Name)
+	if K.Spec.Template != nil {
+		rep.Warnf(report.CodeTemplateSplit, "%v/%v: the template is only kept on %v and only sees the keys read from %v", K.ObjectMeta.Namespace, K.ObjectMeta.Name, K.ObjectMeta.Name, primary)
+	}
+	return ans
+}
+
+func storeLocationKind(K apis.KESExternalSecret) string {
+	if K.Spec.BackendType == "azureKeyVault" {
+		return "key vaults"
+	}
+	return "projects"
+}
+
+func setStoreLocation(K *apis.KESExternalSecret, location string) {
+	switch K.Spec.BackendType {
+	case "azureKeyVault":
+		K.Spec.KeyVaultName = location
+	case "gcpSecretsManager":
+		K.Spec.ProjectID = location
+	}
+}
+
+// parsePaths converts systemManager `path` entries into dataFrom.find
+// entries. ESO always fetches a path recursively and names keys after the
+// full parameter name, so a name regexp keeps non-recursive entries to the
+// direct children of the path and a rewrite keeps KES' naming, which only
+// uses the last segment of each parameter name.
+func parsePaths(K apis.KESExternalSecret, rep *report.Log) []apis.ESODataFromRef {
+	ans := make([]apis.ESODataFromRef, 0)
+	for _, kesSecretData := range K.Spec.Data {
+		if kesSecretData.Path == "" {
+			continue
+		}
+		if kesSecretData.Key != "" || kesSecretData.Property != "" {
+			rep.Warnf(report.CodePathKeyIgnored, "%v/%v: key and property are ignored on path %v, as KES does", K.ObjectMeta.Namespace, K.ObjectMeta.Name, kesSecretData.Path)
+		}
+		path := strings.TrimSuffix(kesSecretData.Path, "/")
+		if path == "" {
+			path = "/"
+		}
+		find := apis.ESOFind{Path: &path}
+		if kesSecretData.IsBinary {
+			// path is only supported by systemManager, which stores isBinary values as base64
+			find.DecodingStrategy = "Base64"
+		}
+		if !kesSecretData.Recursive {
+			find.Name = &apis.ESOFindName{
+				RegExp: fmt.Sprintf("^%v/[^/]+$", regexp.QuoteMeta(strings.TrimSuffix(path, "/"))),
+			}
+		} else {
+			rep.Warnf(report.CodePathRecursive, "%v/%v: recursive path %v names keys after the last segment of each parameter, nested parameters sharing that segment overwrite each other", K.ObjectMeta.Namespace, K.ObjectMeta.Name, kesSecretData.Path)
+		}
+		ref := apis.ESODataFromRef{
+			Find: &find,
+			Rewrite: []apis.ESORewrite{
+				{Regexp: &apis.ESORewriteRegexp{Source: "^.*/", Target: ""}},
+			},
+		}
+		ans = append(ans, ref)
+	}
+	return ans
+}
+
+// renderExternalSecret returns the object to be written for E, as an
+// external-secrets.io object of the given version. ExternalSecrets that need
+// features missing from external-secrets.io/v1alpha1 are rendered as
+// external-secrets.io/v1beta1 even when v1alpha1 is asked for. From v1beta1
+// on, every dataFrom entry is either an extract or a find.
+func renderExternalSecret(E api.ExternalSecret, ext apis.ESOExtensions, version string, rep *report.Log) (interface{}, error) {
+	if isV1alpha1(version) {
+		if ext.IsEmpty() {
+			return E, nil
+		}
+		rep.Warnf(report.CodeRenderedV1beta1, "%v/%v needs features missing from external-secrets.io/v1alpha1, rendering it as external-secrets.io/v1beta1", E.ObjectMeta.Namespace, E.ObjectMeta.Name)
+		version = apis.ESOAPIVersionV1beta1
+	}
+	dat, err := json.Marshal(E)
+	if err != nil {
+		return nil, err
+	}
+	obj := map[string]interface{}{}
+	err = json.Unmarshal(dat, &obj)
+	if err != nil {
+		return nil, err
+	}
+	obj["apiVersion"] = "external-secrets.io/" + version
+	spec := obj["spec"].(map[string]interface{})
+	dataFrom := make([]interface{}, 0)
+	if old, ok := spec["dataFrom"].([]interface{}); ok {
+		for idx, ref := range old {
+			if strategy, ok := ext.DataFromDecodingStrategy[idx]; ok {
+				ref.(map[string]interface{})["decodingStrategy"] = strategy
+			}
+			dataFrom = append(dataFrom, map[string]interface{}{"extract": ref})
+		}
+	}
+	for _, ref := range ext.DataFrom {
+		dataFrom = append(dataFrom, ref)
+	}
+	delete(spec, "dataFrom")
+	if len(dataFrom) > 0 {
+		spec["dataFrom"] = dataFrom
+	}
+	if data, ok := spec["data"].([]interface{}); ok {
+		for _, entry := range data {
+			entry := entry.(map[string]interface{})
+			strategy, ok := ext.DecodingStrategy[entry["secretKey"].(string)]
+			if ok {
+				entry["remoteRef"].(map[string]interface{})["decodingStrategy"] = strategy
+			}
+		}
+	}
+	if E.Spec.Target.Template != nil && len(E.Spec.Target.Template.Data) > 0 {
+		// v1beta1 defaults to engine v2, templates kept on engine v1 must say so
+		engine := ext.TemplateEngine
+		if engine == "" {
+			engine = templateEngineV1
+		}
+		target := spec["target"].(map[string]interface{})
+		target["template"].(map[string]interface{})["engineVersion"] = engine
+	}
+	return obj, nil
+}
+
+// renderSecretStore returns the object to be written for S, as an
+// external-secrets.io object of the given version. SecretStores using a
+// provider missing from external-secrets.io/v1alpha1 are rendered as
+// external-secrets.io/v1beta1 even when v1alpha1 is asked for.
+func renderSecretStore(S api.SecretStore, ext apis.ESOStoreExtensions, version string, rep *report.Log) (interface{}, error) {
+	if isV1alpha1(version) {
+		if ext.IsEmpty() {
+			return S, nil
+		}
+		rep.Warnf(report.CodeRenderedV1beta1, "%v %v uses a provider missing from external-secrets.io/v1alpha1, rendering it as external-secrets.io/v1beta1", S.Kind, S.ObjectMeta.Name)
+		version = apis.ESOAPIVersionV1beta1
+	}
+	dat, err := json.Marshal(S)
+	if err != nil {
+		return nil, err
+	}
+	obj := map[string]interface{}{}
+	err = json.Unmarshal(dat, &obj)
+	if err != nil {
+		return nil, err
+	}
+	obj["apiVersion"] = "external-secrets.io/" + version
+	spec := obj["spec"].(map[string]interface{})
+	if ext.Akeyless != nil {
+		spec["provider"] = map[string]interface{}{"akeyless": ext.Akeyless}
+	}
+	if providers, ok := spec["provider"].(map[string]interface{}); ok {
+		if alibaba, ok := providers["alibaba"].(map[string]interface{}); ok {
+			// dropped by bindProvider, ESO reads the endpoint from regionID
+			delete(alibaba, "endpoint")
+		}
+	}
+	return obj, nil
+}
+
+// fillTemplate maps a KES template onto an ESO template. Values using lodash
+// are translated for the given ESO template engine. Whatever can't be
+// translated is reported and left out, so the rest of the ExternalSecret can
+// still be migrated.
+func fillTemplate(template *api.ExternalSecretTemplate, m map[string]interface{}, engine string, rep *report.Log) (api.ExternalSecretTemplate, error) {
 	tm := api.ExternalSecretTemplateMetadata{}
 	ans := api.ExternalSecretTemplate{}
 	if template != nil {
 		ans = *template
 	}
+	for _, k := range mapLoop(m) {
+		rep.Skipf(report.CodeTemplateSkipped, "template."+k, "template.%v templating is currently not supported, skipping it", k)
+	}
 	v, ok := m["type"]
 	if ok {
 		ans.Type = corev1.SecretType(v.(string))
 	}
-	v, ok = m["data"]
-	if ok {
-		ans.Data = make(map[string]string)
-		metadata, ok := v.(map[string]interface{})
-		if ok {
-			for k, v := range metadata {
-				ans.Data[k] = v.(string)
+	// stringData goes last, it wins over data as it does on a Secret
+	for _, field := range []string{"data", "stringData"} {
+		v, ok = m[field]
+		if !ok {
+			continue
+		}
+		if ans.Data == nil {
+			ans.Data = make(map[string]string)
+		}
+		values, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, k := range sortedKeys(values) {
+			value, ok := values[k].(string)
+			if !ok {
+				rep.Skipf(report.CodeTemplateSkipped, fmt.Sprintf("template.%v.%v", field, k), "template.%v.%v is not a string, skipping it", field, k)
+				continue
 			}
+			translated, err := translateTemplate(value, engine, field == "data")
+			if err != nil {
+				rep.Skipf(report.CodeTemplateSkipped, fmt.Sprintf("template.%v.%v", field, k), "template.%v.%v: %v. Skipping it, add it to the ExternalSecret manually", field, k, err)
+				continue
+			}
+			ans.Data[k] = translated
 		}
 	}
 	v, ok = m["metadata"]
@@ -337,9 +1030,7 @@ func fillTemplate(template *api.ExternalSecretTemplate, m map[string]interface{}
 				tm.Annotations = make(map[string]string)
 				meta, ok := annot.(map[string]interface{})
 				if ok {
-					for k, v := range meta {
-						tm.Annotations[k] = v.(string)
-					}
+					fillTemplateMetadata(tm.Annotations, meta, "annotations", rep)
 				}
 			}
 			label, oklab := n["labels"]
@@ -347,9 +1038,7 @@ func fillTemplate(template *api.ExternalSecretTemplate, m map[string]interface{}
 				tm.Labels = make(map[string]string)
 				meta, ok := label.(map[string]interface{})
 				if ok {
-					for k, v := range meta {
-						tm.Labels[k] = v.(string)
-					}
+					fillTemplateMetadata(tm.Labels, meta, "labels", rep)
 				}
 			}
 		}
@@ -358,6 +1047,29 @@ func fillTemplate(template *api.ExternalSecretTemplate, m map[string]interface{}
 	ans.Metadata = tm
 	return ans, nil
 }
+
+// fillTemplateMetadata copies literal labels or annotations. ESO does not
+// render templates in metadata, so templated ones are reported and skipped.
+func fillTemplateMetadata(dst map[string]string, src map[string]interface{}, field string, rep *report.Log) {
+	for _, k := range sortedKeys(src) {
+		value, ok := src[k].(string)
+		if !ok || isLodashTemplate(value) {
+			rep.Skipf(report.CodeTemplateSkipped, fmt.Sprintf("template.metadata.%v.%v", field, k), "template.metadata.%v.%v: %q can't be templated by ESO, skipping it", field, k, src[k])
+			continue
+		}
+		dst[k] = value
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	ans := make([]string, 0, len(m))
+	for k := range m {
+		ans = append(ans, k)
+	}
+	sort.Strings(ans)
+	return ans
+}
+
 func linkSecretStore(E api.ExternalSecret, S api.SecretStore) api.ExternalSecret {
 	ext := E
 	ext.Spec.SecretStoreRef.Name = S.ObjectMeta.Name
@@ -366,72 +1078,468 @@ func linkSecretStore(E api.ExternalSecret, S api.SecretStore) api.ExternalSecret
 }
 
 type RootResponse struct {
-	Path string
-	Kes  apis.KESExternalSecret
-	Es   api.ExternalSecret
-	Ss   api.SecretStore
+	Path  string
+	Index int
+	Kes   apis.KESExternalSecret
+	Es    api.ExternalSecret
+	Ext   apis.ESOExtensions
+	Ss    api.SecretStore
+	SsExt apis.ESOStoreExtensions
+	Err   error
 }
 
-func Root(ctx context.Context, client *provider.KesToEsoClient) []RootResponse {
+// Root converts every KES ExternalSecret of the input, writing the generated
+// files, and reports how each input file was converted. Documents are
+// converted by Options.Workers workers, but stores are bound and files
+// written in namespace/name order, so the output doesn't depend on the
+// scheduling.
+func Root(ctx context.Context, client *provider.KesToEsoClient) ([]RootResponse, report.Report) {
 	ans := make([]RootResponse, 0)
-	var files []string
-	err := filepath.Walk(client.Options.InputPath, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			files = append(files, path)
+	rep := report.Report{Files: make([]report.File, 0)}
+	client.Profiles = provider.NewProfileCache()
+	if client.Options.DetectKES {
+		workload, err := client.DetectKESWorkload(ctx)
+		if err != nil {
+			rep.Warnf(report.CodeKESDetection, "Could not find the KES deployment %v/%v: %v", client.Options.Namespace, client.Options.DeploymentName, err)
+		} else if workload != nil {
+			log.Infof("KES deployment %v/%v not found, reading credentials from %v", client.Options.Namespace, client.Options.DeploymentName, workload)
+			client.UseKESWorkload(*workload)
 		}
-		return nil
-	})
+	}
+	instances, err := client.DiscoverKESInstances(ctx)
 	if err != nil {
-		log.Fatal(err)
+		rep.Warnf(report.CodeInstanceDiscovery, "Could not discover KES instances: %v. Reading credentials from deployment %v for every ExternalSecret", err, client.Options.DeploymentName)
+	} else {
+		client.Instances = instances
 	}
-	for _, file := range files {
-		log.Debugln("Looking for ", file)
-		K, err := readKESFromFile(file)
+	reportKESEnv(ctx, client, &rep)
+	stores := NewSecretStoreDB()
+	// Stores of a helm chart are templates, generating the same content
+	// again gives the same store name.
+	if client.Options.ReuseOutputStores && !client.Options.ToStdout && client.Options.OutputPath != "" && client.Options.OutputLayout != apis.OutputLayoutHelm {
+		err = LoadStoresFromDir(stores, client.Options.OutputPath)
 		if err != nil {
-			panic(err)
+			rep.Warnf(report.CodeStoreLoad, "Could not load stores from %v: %v", client.Options.OutputPath, err)
 		}
-		if !utils.IsKES(K) {
-			log.Errorf("Not a KES File: %v\n", file)
-			continue
+	}
+	if client.Options.ReuseClusterStores {
+		err = LoadStoresFromCluster(ctx, stores, client)
+		if err != nil {
+			rep.Warnf(report.CodeStoreLoad, "Could not load stores from the cluster: %v", err)
 		}
-		err = canMigrateKes(K)
+	}
+	var items []workItem
+	var files []inputFile
+	if client.Options.FromCluster {
+		kes, err := client.ListKESExternalSecrets(ctx)
 		if err != nil {
-			log.Errorf("Cannot process file %v, %v. Skipping", file, err)
-			continue
+			log.Errorf("Could not list KES ExternalSecrets from cluster: %v", err)
+			rep.AddFile("cluster", nil, err)
+			return ans, rep
 		}
-		E, err := parseGenerals(K, NewESOSecret(), client.Options)
+		for _, K := range kes {
+			source := fmt.Sprintf("cluster:%v/%v", K.ObjectMeta.Namespace, K.ObjectMeta.Name)
+			files = append(files, inputFile{path: source, items: []int{len(items)}})
+			items = append(items, workItem{file: source, doc: kesDocument{Kes: K}})
+		}
+	} else {
+		var paths []string
+		err = filepath.Walk(client.Options.InputPath, func(path string, info os.FileInfo, err error) error {
+			if !info.IsDir() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
 		if err != nil {
-			log.Errorf("Could not process file %v: %v. Skipping.", file, err)
-			continue
+			log.Fatal(err)
+		}
+		for _, path := range paths {
+			log.Debugln("Looking for ", path)
+			docs, err := readKESFromFile(path)
+			if err != nil {
+				log.Errorf("Could not read file %v: %v. Skipping.", path, err)
+				ans = append(ans, RootResponse{Path: path, Err: err})
+				files = append(files, inputFile{path: path, err: err})
+				continue
+			}
+			file := inputFile{path: path}
+			for _, doc := range docs {
+				file.items = append(file.items, len(items))
+				items = append(items, workItem{file: path, doc: doc})
+			}
+			files = append(files, file)
 		}
-		E, err = parseSpecifics(K, E)
+	}
+	order := sortedItems(items)
+	converted := convertItems(ctx, client, stores, items, order)
+	for _, i := range order {
+		ans = append(ans, converted[i].responses...)
+	}
+	for _, file := range files {
+		docs := make([]report.Document, 0, len(file.items))
+		for _, i := range file.items {
+			docs = append(docs, converted[i].rep)
+		}
+		rep.AddFile(file.path, docs, file.err)
+	}
+	finishRun(client, stores, &rep)
+	return ans, rep
+}
+
+// reportKESEnv warns about the envFrom sources of the KES workloads that
+// could not be read, as the credentials they hold are missing from the
+// generated stores.
+func reportKESEnv(ctx context.Context, client *provider.KesToEsoClient, rep *report.Report) {
+	ids := make([]string, 0, len(client.Instances))
+	for id := range client.Instances {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	clients := []*provider.KesToEsoClient{client}
+	for _, id := range ids {
+		clients = append(clients, client.ForInstance(id))
+	}
+	for _, c := range clients {
+		profile, err := c.KESProfile(ctx)
 		if err != nil {
-			log.Errorf("Could not process file %v: %v. Skipping.", file, err)
 			continue
 		}
-		S := utils.NewSecretStore(client.Options.SecretStore)
-		S, newProvider := bindProvider(ctx, S, K, client)
-		secret_filename := fmt.Sprintf("%v/external-secret-%v.yaml", client.Options.OutputPath, E.ObjectMeta.Name)
-		if newProvider {
-			store_filename := fmt.Sprintf("%v/secret-store-%v.yaml", client.Options.OutputPath, S.ObjectMeta.Name)
-			err = utils.WriteYaml(S, store_filename, client.Options.ToStdout)
-			if err != nil {
-				panic(err)
+		for _, problem := range profile.EnvProblems {
+			rep.Warnf(report.CodeKESEnv, "KES %v %v/%v: %v", c.Options.WorkloadKind, profile.Namespace, profile.DeploymentName, problem)
+		}
+	}
+}
+
+// workItem is a document to convert, read from file.
+type workItem struct {
+	file string
+	doc  kesDocument
+}
+
+// inputFile is an input file, or an ExternalSecret read from the cluster,
+// along with the work items of its documents.
+type inputFile struct {
+	path  string
+	items []int
+	err   error
+}
+
+type convertedItem struct {
+	responses []RootResponse
+	rep       report.Document
+}
+
+// sortedItems returns the indexes of items sorted by namespace/name of
+// their KES ExternalSecret. Documents that could not be read come first, in
+// input order.
+func sortedItems(items []workItem) []int {
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		A, B := items[order[a]].doc.Kes.ObjectMeta, items[order[b]].doc.Kes.ObjectMeta
+		if A.Namespace != B.Namespace {
+			return A.Namespace < B.Namespace
+		}
+		return A.Name < B.Name
+	})
+	return order
+}
+
+// convertItems prepares items concurrently and commits them in the given
+// order, each as soon as it and the items before it are prepared.
+func convertItems(ctx context.Context, client *provider.KesToEsoClient, stores StoreDB, items []workItem, order []int) []convertedItem {
+	workers := client.Options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	pending := make([]pendingDocument, len(items))
+	ready := make([]chan struct{}, len(items))
+	for i := range ready {
+		ready[i] = make(chan struct{})
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				pending[i] = prepareDocument(ctx, client, items[i].file, items[i].doc)
+				close(ready[i])
 			}
+		}()
+	}
+	go func() {
+		for _, i := range order {
+			jobs <- i
 		}
-		E = linkSecretStore(E, S)
-		err = utils.WriteYaml(E, secret_filename, client.Options.ToStdout)
+		close(jobs)
+	}()
+	ans := make([]convertedItem, len(items))
+	for _, i := range order {
+		<-ready[i]
+		responses, rep := commitDocument(client, stores, pending[i])
+		ans[i] = convertedItem{responses: responses, rep: rep}
+		pending[i] = pendingDocument{}
+	}
+	wg.Wait()
+	return ans
+}
+
+// finishRun reports which stores the run used and, with the kustomize layout,
+// lists the generated files in kustomization.yaml files. With the helm layout
+// it turns them into a chart.
+func finishRun(client *provider.KesToEsoClient, stores StoreDB, rep *report.Report) {
+	reportStoreUsage(stores, rep)
+	if client.Options.ToStdout {
+		return
+	}
+	switch client.Options.OutputLayout {
+	case apis.OutputLayoutKustomize:
+		err := utils.WriteKustomizations(client.Options.OutputPath, client.Options.StoresComponent)
 		if err != nil {
-			panic(err)
+			rep.Warnf(report.CodeKustomization, "Could not write kustomization files to %v: %v", client.Options.OutputPath, err)
 		}
-		response := RootResponse{
-			Path: file,
-			Kes:  K,
-			Es:   E,
-			Ss:   S,
+	case apis.OutputLayoutHelm:
+		leftOut, err := utils.WriteHelmChart(client.Options.OutputPath, client.Options.HelmChartName, client.Options.HelmCredentialValues)
+		if err != nil {
+			rep.Warnf(report.CodeHelmChart, "Could not write helm chart to %v: %v", client.Options.OutputPath, err)
 		}
-		ans = append(ans, response)
+		for _, secret := range leftOut {
+			rep.Warnf(report.CodeHelmCredentials, "Credential Secret %v holds static credentials found in KES and is left out of the chart. Create it in every environment, or pass --helm-credential-values to copy its data into values.yaml", secret)
+		}
+	}
+}
+
+// pendingDocument is a KES document converted up to its stores, which
+// commitDocument binds before writing the generated files.
+type pendingDocument struct {
+	responses []RootResponse // set when the document was not converted
+	splits    []pendingSplit
+	output    *utils.ManifestBuffer // credential Secrets to write
+	rep       report.Document
+}
+
+type pendingSplit struct {
+	response RootResponse // Err is set when the split was not converted
+	K        apis.KESExternalSecret
+	E        api.ExternalSecret
+	ext      apis.ESOExtensions
+	S        api.SecretStore
+	storeExt apis.ESOStoreExtensions
+}
+
+func convertDocument(ctx context.Context, client *provider.KesToEsoClient, stores StoreDB, file string, doc kesDocument) ([]RootResponse, report.Document) {
+	return commitDocument(client, stores, prepareDocument(ctx, client, file, doc))
+}
+
+// prepareDocument does the part of the conversion that doesn't depend on
+// other documents, so that it can run concurrently.
+func prepareDocument(ctx context.Context, client *provider.KesToEsoClient, file string, doc kesDocument) pendingDocument {
+	response := RootResponse{
+		Path:  file,
+		Index: doc.Index,
+		Kes:   doc.Kes,
+	}
+	pending := pendingDocument{
+		output: &utils.ManifestBuffer{},
+		rep:    report.Document{Index: doc.Index},
+	}
+	rep := &pending.rep
+	if doc.Err != nil {
+		log.Errorf("Could not parse document %v of file %v: %v. Skipping.", doc.Index, file, doc.Err)
+		response.Err = doc.Err
+		rep.Fail(doc.Err)
+		pending.responses = []RootResponse{response}
+		return pending
+	}
+	K := doc.Kes
+	if !utils.IsKES(K) {
+		log.Errorf("Not a KES document: %v (document %v)\n", file, doc.Index)
+		response.Err = errors.New("not a KES ExternalSecret")
+		rep.Status = report.StatusSkipped
+		rep.Error = response.Err.Error()
+		pending.responses = []RootResponse{response}
+		return pending
+	}
+	rep.Name = fmt.Sprintf("%v/%v", K.ObjectMeta.Namespace, K.ObjectMeta.Name)
+	err := canMigrateKes(K)
+	if err != nil {
+		log.Errorf("Cannot process document %v of file %v, %v. Skipping", doc.Index, file, err)
+		response.Err = err
+		rep.Fail(err)
+		pending.responses = []RootResponse{response}
+		return pending
+	}
+	docClient := *client
+	docClient.Output = pending.output
+	for _, split := range splitByStore(K, &rep.Log) {
+		pending.splits = append(pending.splits, prepareSplit(ctx, &docClient, response, split, rep))
+	}
+	return pending
+}
+
+// commitDocument binds the stores of a prepared document and writes its
+// files. Documents are committed one at a time, in a stable order.
+func commitDocument(client *provider.KesToEsoClient, stores StoreDB, pending pendingDocument) ([]RootResponse, report.Document) {
+	rep := pending.rep
+	if pending.responses != nil {
+		return pending.responses, rep
+	}
+	err := pending.output.Flush(client.Options.ToStdout)
+	if err != nil {
+		rep.Warnf(report.CodeProviderCredentials, "Could not write provider credentials: %v", err)
+	}
+	ans := make([]RootResponse, 0, len(pending.splits))
+	for _, split := range pending.splits {
+		converted := commitSplit(client, stores, split, &rep)
+		if converted.Err != nil {
+			rep.Fail(converted.Err)
+		}
+		ans = append(ans, converted)
+	}
+	rep.Done()
+	return ans, rep
+}
+
+func prepareSplit(ctx context.Context, client *provider.KesToEsoClient, response RootResponse, split storeSplit, rep *report.Document) pendingSplit {
+	K := split.Kes
+	file := response.Path
+	pending := pendingSplit{K: K}
+	E, err := parseGenerals(K, NewESOSecret(), client.Options, &rep.Log)
+	if err != nil {
+		log.Errorf("Could not process document %v of file %v: %v. Skipping.", response.Index, file, err)
+		response.Err = err
+		pending.response = response
+		return pending
+	}
+	E, err = parseSpecifics(K, E)
+	if err != nil {
+		log.Errorf("Could not process document %v of file %v: %v. Skipping.", response.Index, file, err)
+		response.Err = err
+		pending.response = response
+		return pending
+	}
+	E.Spec.Target.Name = split.Target
+	if !split.Primary {
+		E.Spec.Target.CreationPolicy = api.Merge
+	}
+	ext := apis.ESOExtensions{
+		DataFrom: parsePaths(K, &rep.Log),
+	}
+	storeClient := client.ForInstance(K.Spec.ControllerId)
+	if K.Spec.ControllerId != "" && storeClient == client {
+		rep.Warnf(report.CodeUnknownInstance, "%v/%v: no KES deployment found with INSTANCE_ID %v, reading credentials from %v", K.ObjectMeta.Namespace, K.ObjectMeta.Name, K.Spec.ControllerId, client.Options.DeploymentName)
+	}
+	S := utils.NewSecretStore(client.Options.SecretStore)
+	if !isV1alpha1(client.Options.ESOAPIVersion) {
+		ext.TemplateEngine = templateEngineV2
+		ext.DecodingStrategy, err = decodingStrategies(K, E.Spec.Target.Template, &rep.Log)
+		if err == nil {
+			ext.DataFromDecodingStrategy, err = dataFromDecodingStrategies(K)
+		}
+		if err != nil {
+			log.Errorf("Could not process document %v of file %v: %v. Skipping.", response.Index, file, err)
+			response.Err = err
+			pending.response = response
+			return pending
+		}
+	}
+	var hasStore bool
+	pending.S, pending.storeExt, hasStore = fillProvider(ctx, S, K, storeClient, &rep.Log)
+	if !hasStore {
+		// ESO rejects an ExternalSecret without a store to read from
+		err = fmt.Errorf("no SecretStore can be built for backend %v", K.Spec.BackendType)
+		rep.Warnf(report.CodeNoStore, "Could not process document %v of file %v: %v. Skipping the ExternalSecret", response.Index, file, err)
+		response.Err = err
+		pending.response = response
+		return pending
+	}
+	pending.response = response
+	pending.E = E
+	pending.ext = ext
+	return pending
+}
+
+func commitSplit(client *provider.KesToEsoClient, stores StoreDB, split pendingSplit, rep *report.Document) RootResponse {
+	response := split.response
+	if response.Err != nil {
+		return response
+	}
+	E, ext := split.E, split.ext
+	S, storeExt, newProvider := bindStore(split.S, split.storeExt, split.K, client, stores, &rep.Log)
+	secret_filename := utils.ObjectFile(client.Options, E.ObjectMeta.Namespace, "external-secret", E.ObjectMeta.Name)
+	if newProvider {
+		storeNamespace := ""
+		if S.Kind == "SecretStore" {
+			storeNamespace = S.ObjectMeta.Namespace
+		}
+		store_filename := utils.ObjectFile(client.Options, storeNamespace, "secret-store", S.ObjectMeta.Name)
+		store, err := renderSecretStore(S, storeExt, client.Options.ESOAPIVersion, &rep.Log)
+		if err == nil {
+			err = utils.WriteYaml(store, store_filename, client.Options.ToStdout)
+		}
+		if err != nil {
+			log.Errorf("Could not write %v %v for document %v of file %v: %v. Skipping.", S.Kind, S.ObjectMeta.Name, response.Index, response.Path, err)
+			response.Err = err
+			return response
+		}
+		rep.Objects = append(rep.Objects, reportObject(store, store_filename, client.Options.ToStdout))
+	}
+	E = linkSecretStore(E, S)
+	rendered, err := renderExternalSecret(E, ext, client.Options.ESOAPIVersion, &rep.Log)
+	if err == nil {
+		err = utils.WriteYaml(rendered, secret_filename, client.Options.ToStdout)
+	}
+	if err != nil {
+		log.Errorf("Could not write ExternalSecret %v for document %v of file %v: %v. Skipping.", E.ObjectMeta.Name, response.Index, response.Path, err)
+		response.Err = err
+		return response
+	}
+	rep.Objects = append(rep.Objects, reportObject(rendered, secret_filename, client.Options.ToStdout))
+	binding := report.StoreBinding{
+		ExternalSecret: fmt.Sprintf("%v/%v", E.ObjectMeta.Namespace, E.ObjectMeta.Name),
+		Kind:           S.Kind,
+		Name:           S.ObjectMeta.Name,
+		Created:        newProvider,
+		Source:         storeSource(stores, S),
+	}
+	if S.Kind == "SecretStore" {
+		binding.Namespace = S.ObjectMeta.Namespace
+	}
+	rep.Bindings = append(rep.Bindings, binding)
+	response.Es = E
+	response.Ext = ext
+	response.Ss = S
+	response.SsExt = storeExt
+	return response
+}
+
+// reportObject describes a rendered object written to path.
+func reportObject(obj interface{}, path string, toStdout bool) report.Object {
+	ans := report.Object{}
+	if !toStdout {
+		ans.Path = path
+	}
+	dat, err := json.Marshal(obj)
+	if err != nil {
+		return ans
+	}
+	meta := struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata"`
+	}{}
+	if json.Unmarshal(dat, &meta) != nil {
+		return ans
 	}
+	ans.APIVersion = meta.APIVersion
+	ans.Kind = meta.Kind
+	ans.Name = meta.Name
+	ans.Namespace = meta.Namespace
 	return ans
 }
 
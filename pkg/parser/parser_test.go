@@ -5,14 +5,24 @@ import (
 	"fmt"
 	"kestoeso/pkg/apis"
 	"kestoeso/pkg/provider"
+	"kestoeso/pkg/report"
 	"kestoeso/pkg/utils"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	testclient "k8s.io/client-go/kubernetes/fake"
 	yaml "sigs.k8s.io/yaml"
 )
@@ -52,7 +62,7 @@ func TestBindAWSSMProvider(t *testing.T) {
 					Name:         "password",
 					SecretType:   "",
 					Property:     "password",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -62,7 +72,7 @@ func TestBindAWSSMProvider(t *testing.T) {
 					Name:         "username",
 					SecretType:   "",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -85,7 +95,7 @@ func TestBindAWSSMProvider(t *testing.T) {
 		Client:  faker,
 		Options: &apis.KesToEsoOptions{},
 	}
-	got, _ := bindProvider(ctx, S, K, &c)
+	got, _, _ := bindProvider(ctx, S, K, &c, NewSecretStoreDB(), nil)
 	// Forcing name to be equal, since it's randomly generated
 	want.ObjectMeta.Name = got.ObjectMeta.Name
 	if !reflect.DeepEqual(want, got) {
@@ -94,6 +104,37 @@ func TestBindAWSSMProvider(t *testing.T) {
 
 }
 
+func TestBindAWSPodRole(t *testing.T) {
+	ctx := context.TODO()
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubernetes-external-secrets", Namespace: "kes"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{provider.AWSPodRoleAnnotation: "kes-reader"}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "kubernetes-external-secrets"}}},
+		}},
+	}
+	opt := apis.NewOptions()
+	opt.Namespace = "kes"
+	c := provider.KesToEsoClient{Client: testclient.NewSimpleClientset(deployment), Options: opt}
+	K := apis.KESExternalSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "aws", Namespace: "app"},
+		Spec: apis.KESExternalSecretSpec{
+			BackendType: "secretsManager",
+			Region:      "eu-west-1",
+			Data:        []apis.KESExternalSecretData{{Key: "app/credentials", Name: "password"}},
+		},
+	}
+	rep := &report.Log{}
+	S, _, _ := bindProvider(ctx, utils.NewSecretStore(false), K, &c, NewSecretStoreDB(), rep)
+	assert.Equal(t, api.AWSAuth{}, S.Spec.Provider.AWS.Auth)
+	assert.Equal(t, "", S.Spec.Provider.AWS.Role)
+	if assert.Len(t, rep.Warnings, 1) {
+		assert.Equal(t, report.CodeAWSPodRole, rep.Warnings[0].Code)
+		assert.Contains(t, rep.Warnings[0].Message, "iam.amazonaws.com/role: kes-reader")
+		assert.Contains(t, rep.Warnings[0].Message, "not an ARN")
+	}
+}
+
 func TestBindAWSPSProvider(t *testing.T) {
 	ctx := context.TODO()
 	K := apis.KESExternalSecret{
@@ -119,7 +160,7 @@ func TestBindAWSPSProvider(t *testing.T) {
 					Name:         "password",
 					SecretType:   "",
 					Property:     "password",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -129,7 +170,7 @@ func TestBindAWSPSProvider(t *testing.T) {
 					Name:         "username",
 					SecretType:   "",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -152,7 +193,7 @@ func TestBindAWSPSProvider(t *testing.T) {
 		Client:  faker,
 		Options: &apis.KesToEsoOptions{},
 	}
-	got, _ := bindProvider(ctx, S, K, &c)
+	got, _, _ := bindProvider(ctx, S, K, &c, NewSecretStoreDB(), nil)
 	// Forcing name to be equal, since it's randomly generated
 	want.ObjectMeta.Name = got.ObjectMeta.Name
 	if !reflect.DeepEqual(want, got) {
@@ -182,7 +223,7 @@ func TestBindGCPProvider(t *testing.T) {
 					Name:         "password",
 					SecretType:   "",
 					Property:     "password",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -192,7 +233,7 @@ func TestBindGCPProvider(t *testing.T) {
 					Name:         "username",
 					SecretType:   "",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -213,7 +254,7 @@ func TestBindGCPProvider(t *testing.T) {
 		Client:  faker,
 		Options: &apis.KesToEsoOptions{},
 	}
-	got, _ := bindProvider(ctx, S, K, &c)
+	got, _, _ := bindProvider(ctx, S, K, &c, NewSecretStoreDB(), nil)
 	// Forcing name to be equal, since it's randomly generated
 	want.ObjectMeta.Name = got.ObjectMeta.Name
 	if !reflect.DeepEqual(want, got) {
@@ -242,7 +283,7 @@ func TestBindIBMProvider(t *testing.T) {
 					Name:         "password",
 					SecretType:   "username_password",
 					Property:     "password",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -252,7 +293,7 @@ func TestBindIBMProvider(t *testing.T) {
 					Name:         "username",
 					SecretType:   "username_password",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -272,7 +313,7 @@ func TestBindIBMProvider(t *testing.T) {
 		Client:  faker,
 		Options: &apis.KesToEsoOptions{},
 	}
-	got, _ := bindProvider(ctx, S, K, &c)
+	got, _, _ := bindProvider(ctx, S, K, &c, NewSecretStoreDB(), nil)
 	// Forcing name to be equal, since it's randomly generated
 	want.ObjectMeta.Name = got.ObjectMeta.Name
 	if !reflect.DeepEqual(want, got) {
@@ -305,7 +346,7 @@ func TestBindAzureProvider(t *testing.T) {
 					Name:         "password",
 					SecretType:   "",
 					Property:     "password",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -315,7 +356,7 @@ func TestBindAzureProvider(t *testing.T) {
 					Name:         "username",
 					SecretType:   "",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -337,7 +378,7 @@ func TestBindAzureProvider(t *testing.T) {
 		Client:  faker,
 		Options: &apis.KesToEsoOptions{},
 	}
-	got, _ := bindProvider(ctx, S, K, &c)
+	got, _, _ := bindProvider(ctx, S, K, &c, NewSecretStoreDB(), nil)
 	// Forcing name to be equal, since it's randomly generated
 	want.ObjectMeta.Name = got.ObjectMeta.Name
 	if !reflect.DeepEqual(want, got) {
@@ -369,7 +410,7 @@ func TestBindVaultProvider(t *testing.T) {
 					Name:         "password",
 					SecretType:   "",
 					Property:     "password",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -379,7 +420,7 @@ func TestBindVaultProvider(t *testing.T) {
 					Name:         "username",
 					SecretType:   "",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -408,7 +449,7 @@ func TestBindVaultProvider(t *testing.T) {
 		Client:  faker,
 		Options: &apis.KesToEsoOptions{},
 	}
-	got, _ := bindProvider(ctx, S, K, &c)
+	got, _, _ := bindProvider(ctx, S, K, &c, NewSecretStoreDB(), nil)
 	// Forcing name to be equal, since it's randomly generated
 	want.ObjectMeta.Name = got.ObjectMeta.Name
 	if !reflect.DeepEqual(want, got) {
@@ -441,7 +482,7 @@ func TestParseGenerals(t *testing.T) {
 					Name:         "password",
 					SecretType:   "",
 					Property:     "password",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -451,7 +492,7 @@ func TestParseGenerals(t *testing.T) {
 					Name:         "username",
 					SecretType:   "",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -461,7 +502,7 @@ func TestParseGenerals(t *testing.T) {
 					Name:         "username",
 					SecretType:   "username_password",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -471,7 +512,7 @@ func TestParseGenerals(t *testing.T) {
 	}
 	opt := apis.KesToEsoOptions{}
 	E := NewESOSecret()
-	got, err := parseGenerals(K, E, &opt)
+	got, err := parseGenerals(K, E, &opt, nil)
 	if err != nil {
 		t.Errorf("want success got err: %v", err)
 	}
@@ -565,7 +606,7 @@ func TestParseSpecifics(t *testing.T) {
 					Name:         "password",
 					SecretType:   "",
 					Property:     "password",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -575,7 +616,7 @@ func TestParseSpecifics(t *testing.T) {
 					Name:         "username",
 					SecretType:   "",
 					Property:     "username",
-					Recursive:    "",
+					Recursive:    false,
 					Path:         "",
 					VersionStage: "",
 					IsBinary:     false,
@@ -714,11 +755,11 @@ type rootStruct struct {
 func loadInput(cases []rootStruct) ([]rootStruct, error) {
 	ans := cases
 	for idx, test := range cases {
-		kes, err := readKESFromFile(fmt.Sprintf("testdata/%v.golden", test.golden))
+		docs, err := readKESFromFile(fmt.Sprintf("testdata/%v.golden", test.golden))
 		if err != nil {
 			return cases, err
 		}
-		ans[idx].input = kes
+		ans[idx].input = docs[0].Kes
 	}
 	return ans, nil
 }
@@ -812,8 +853,17 @@ func TestRoot(t *testing.T) {
 		Client:  faker,
 		Options: &options,
 	}
-	resp := Root(ctx, &c)
-	for idx, testcase := range testCases {
+	resp, _ := Root(ctx, &c)
+	for _, testcase := range testCases {
+		idx := -1
+		for i, r := range resp {
+			if r.Path == fmt.Sprintf("testdata/%v.golden", testcase.golden) {
+				idx = i
+			}
+		}
+		if !assert.NotEqual(t, -1, idx, testcase.golden) {
+			continue
+		}
 		assert.Equal(t, testcase.externalSecretWants, resp[idx].Es)
 		if testcase.secretStoreWants != nil {
 			assert.Equal(t, *testcase.secretStoreWants, resp[idx].Ss)
@@ -826,3 +876,1259 @@ func TestRoot(t *testing.T) {
 	}
 
 }
+
+func TestReadKESFromFileMultiDocument(t *testing.T) {
+	content := `---
+apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: first
+spec:
+  backendType: secretsManager
+---
+# only a comment
+---
+apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: second
+spec:
+  backendType: systemManager
+---
+apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata: [
+`
+	file := fmt.Sprintf("%v/multi.yaml", t.TempDir())
+	err := os.WriteFile(file, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := readKESFromFile(file)
+	assert.NoError(t, err)
+	if assert.Len(t, docs, 3) {
+		assert.Equal(t, 0, docs[0].Index)
+		assert.Equal(t, "first", docs[0].Kes.ObjectMeta.Name)
+		assert.Equal(t, 1, docs[1].Index)
+		assert.Equal(t, "second", docs[1].Kes.ObjectMeta.Name)
+		assert.Equal(t, "systemManager", docs[1].Kes.Spec.BackendType)
+		assert.Equal(t, 2, docs[2].Index)
+		assert.Error(t, docs[2].Err)
+	}
+}
+
+// newBackendsDeployment is a KES deployment in kes-ns holding credentials
+// for the backends configured through environment variables: literals, and
+// AWS keys read from the aws-credentials Secret.
+func newBackendsDeployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubernetes-external-secrets",
+			Namespace: "kes-ns",
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					ServiceAccountName: "kubernetes-external-secrets",
+					Containers: []corev1.Container{
+						{
+							Name: "kubernetes-external-secrets",
+							Env: []corev1.EnvVar{
+								{Name: "ALICLOUD_ENDPOINT", Value: "https://kms.eu-central-1.aliyuncs.com"},
+								{Name: "ALICLOUD_ACCESS_KEY_ID", Value: "id"},
+								{Name: "ALICLOUD_ACCESS_KEY_SECRET", Value: "secret"},
+								{Name: "AKEYLESS_API_ENDPOINT", Value: "https://api.akeyless.io"},
+								{Name: "AKEYLESS_ACCESS_ID", Value: "p-123456"},
+								{Name: "AKEYLESS_ACCESS_TYPE", Value: "access_key"},
+								{Name: "AKEYLESS_ACCESS_TYPE_PARAM", Value: "key"},
+								{Name: "VAULT_ADDR", Value: "https://vault.example.com:8200"},
+								{Name: "DEFAULT_VAULT_MOUNT_POINT", Value: "kubernetes"},
+								{Name: "DEFAULT_VAULT_ROLE", Value: "kes"},
+								{Name: "AWS_ACCESS_KEY_ID", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+									LocalObjectReference: corev1.LocalObjectReference{Name: "aws-credentials"},
+									Key:                  "access-key-id",
+								}}},
+								{Name: "AWS_SECRET_ACCESS_KEY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+									LocalObjectReference: corev1.LocalObjectReference{Name: "aws-credentials"},
+									Key:                  "secret-access-key",
+								}}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestRootBackends(t *testing.T) {
+	ctx := context.TODO()
+	options := apis.NewOptions()
+	options.Namespace = "kes-ns"
+	options.InputPath = "testdata/backends"
+	options.ToStdout = true
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+		Options: options,
+	}
+	resp, _ := Root(ctx, &c)
+	converted := 0
+	for _, r := range resp {
+		if r.Err != nil { // golden outputs living next to the inputs
+			continue
+		}
+		converted++
+		name := strings.TrimSuffix(filepath.Base(r.Path), ".golden")
+		for prefix, obj := range map[string]func() (interface{}, error){
+			"es": func() (interface{}, error) { return renderExternalSecret(r.Es, r.Ext, "", nil) },
+			"ss": func() (interface{}, error) { return renderSecretStore(r.Ss, r.SsExt, "", nil) },
+		} {
+			rendered, err := obj()
+			assert.NoError(t, err, name)
+			got, err := yaml.Marshal(rendered)
+			assert.NoError(t, err, name)
+			want, err := os.ReadFile(fmt.Sprintf("testdata/backends/%v_%v.golden", prefix, name))
+			assert.NoError(t, err, name)
+			assert.Equal(t, string(want), string(got), name)
+		}
+	}
+	assert.Equal(t, 2, converted)
+}
+
+func TestRootFromCluster(t *testing.T) {
+	ctx := context.TODO()
+	kes := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kubernetes-client.io/v1",
+			"kind":       "ExternalSecret",
+			"metadata": map[string]interface{}{
+				"name":      "from-cluster",
+				"namespace": "kes-ns",
+			},
+			"spec": map[string]interface{}{
+				"backendType": "secretsManager",
+				"data": []interface{}{
+					map[string]interface{}{
+						"key":  "demo-service/credentials",
+						"name": "password",
+					},
+				},
+			},
+		},
+	}
+	listKinds := map[schema.GroupVersionResource]string{
+		provider.KESExternalSecretResource: "ExternalSecretList",
+	}
+	options := apis.KesToEsoOptions{
+		FromCluster: true,
+		ToStdout:    true,
+	}
+	c := provider.KesToEsoClient{
+		Client:        testclient.NewSimpleClientset(),
+		DynamicClient: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, kes),
+		Options:       &options,
+	}
+	resp, _ := Root(ctx, &c)
+	if assert.Len(t, resp, 1) {
+		assert.NoError(t, resp[0].Err)
+		assert.Equal(t, "cluster:kes-ns/from-cluster", resp[0].Path)
+		assert.Equal(t, "from-cluster", resp[0].Es.ObjectMeta.Name)
+		assert.Equal(t, "kes-ns", resp[0].Es.ObjectMeta.Namespace)
+		assert.Equal(t, "demo-service/credentials", resp[0].Es.Spec.Data[0].RemoteRef.Key)
+	}
+}
+
+func TestRootSameNameNamespaces(t *testing.T) {
+	ctx := context.TODO()
+	input := t.TempDir()
+	for _, namespace := range []string{"team-a", "team-b"} {
+		err := os.WriteFile(filepath.Join(input, namespace+".yaml"), []byte(`apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: app
+  namespace: `+namespace+`
+spec:
+  backendType: vault
+  vaultMountPoint: kubernetes
+  vaultRole: app
+  data:
+    - key: secret/data/app
+      name: password
+`), 0644)
+		assert.NoError(t, err)
+	}
+	for layout, dir := range map[string]string{apis.OutputLayoutFlat: "", apis.OutputLayoutHelm: "templates"} {
+		output := t.TempDir()
+		options := apis.NewOptions()
+		options.Namespace = "kes-ns"
+		options.InputPath = input
+		options.OutputPath = output
+		options.OutputLayout = layout
+		c := provider.KesToEsoClient{
+			Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+			Options: options,
+		}
+		Root(ctx, &c)
+		assert.FileExists(t, filepath.Join(output, dir, "external-secret-app.yaml"))
+
+		output = t.TempDir()
+		options.OutputPath = output
+		options.NamespaceFileNames = true
+		Root(ctx, &c)
+		assert.FileExists(t, filepath.Join(output, dir, "external-secret-team-a-app.yaml"))
+		assert.FileExists(t, filepath.Join(output, dir, "external-secret-team-b-app.yaml"))
+		assert.NoFileExists(t, filepath.Join(output, dir, "external-secret-app.yaml"))
+	}
+}
+
+func TestReadKESFromFileList(t *testing.T) {
+	yamlList := `apiVersion: v1
+kind: List
+items:
+- apiVersion: kubernetes-client.io/v1
+  kind: ExternalSecret
+  metadata:
+    name: first
+    namespace: one
+  spec:
+    backendType: secretsManager
+- apiVersion: kubernetes-client.io/v1
+  kind: ExternalSecret
+  metadata:
+    name: second
+    namespace: two
+  spec:
+    backendType: vault
+metadata:
+  resourceVersion: ""
+---
+apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: third
+spec:
+  backendType: gcpSecretsManager
+`
+	jsonList := `{
+    "apiVersion": "kubernetes-client.io/v1",
+    "kind": "ExternalSecretList",
+    "items": [
+        {
+            "apiVersion": "kubernetes-client.io/v1",
+            "kind": "ExternalSecret",
+            "metadata": {"name": "first", "namespace": "one"},
+            "spec": {"backendType": "secretsManager"}
+        },
+        {
+            "apiVersion": "kubernetes-client.io/v1",
+            "kind": "ExternalSecret",
+            "metadata": {"name": "second", "namespace": "two"},
+            "spec": {"backendType": "vault"}
+        }
+    ]
+}
+{
+    "apiVersion": "kubernetes-client.io/v1",
+    "kind": "ExternalSecret",
+    "metadata": {"name": "third"},
+    "spec": {"backendType": "gcpSecretsManager"}
+}
+`
+	for name, content := range map[string]string{"list.yaml": yamlList, "list.json": jsonList} {
+		file := fmt.Sprintf("%v/%v", t.TempDir(), name)
+		err := os.WriteFile(file, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs, err := readKESFromFile(file)
+		assert.NoError(t, err)
+		if assert.Len(t, docs, 3, name) {
+			for idx, want := range []string{"first", "second", "third"} {
+				assert.NoError(t, docs[idx].Err, name)
+				assert.Equal(t, idx, docs[idx].Index, name)
+				assert.Equal(t, want, docs[idx].Kes.ObjectMeta.Name, name)
+				assert.True(t, utils.IsKES(docs[idx].Kes), name)
+			}
+			assert.Equal(t, "two", docs[1].Kes.ObjectMeta.Namespace, name)
+			assert.Equal(t, "vault", docs[1].Kes.Spec.BackendType, name)
+		}
+	}
+}
+
+func TestParsePaths(t *testing.T) {
+	K := apis.KESExternalSecret{
+		Kind:       "ExternalSecret",
+		ApiVersion: "kubernetes-client.io/v1",
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ssm-path",
+			Namespace: "default",
+		},
+		Spec: apis.KESExternalSecretSpec{
+			BackendType: "systemManager",
+			Data: []apis.KESExternalSecretData{
+				{
+					Key:  "/demo-service/username",
+					Name: "username",
+				},
+				{
+					Path: "/demo-service/config/",
+				},
+				{
+					Path:      "/demo-service/nested",
+					Recursive: true,
+				},
+			},
+		},
+	}
+	assert.NoError(t, canMigrateKes(K))
+	E, err := parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []api.ExternalSecretData{
+		{SecretKey: "username", RemoteRef: api.ExternalSecretDataRemoteRef{Key: "/demo-service/username"}},
+	}, E.Spec.Data)
+	configPath := "/demo-service/config"
+	nestedPath := "/demo-service/nested"
+	rewrite := []apis.ESORewrite{{Regexp: &apis.ESORewriteRegexp{Source: "^.*/", Target: ""}}}
+	want := []apis.ESODataFromRef{
+		{
+			Find: &apis.ESOFind{
+				Path: &configPath,
+				Name: &apis.ESOFindName{RegExp: "^/demo-service/config/[^/]+$"},
+			},
+			Rewrite: rewrite,
+		},
+		{
+			Find:    &apis.ESOFind{Path: &nestedPath},
+			Rewrite: rewrite,
+		},
+	}
+	assert.Equal(t, want, parsePaths(K, nil))
+
+	K.Spec.BackendType = "secretsManager"
+	assert.Error(t, canMigrateKes(K))
+}
+
+func TestParseVersion(t *testing.T) {
+	K := apis.KESExternalSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "versions", Namespace: "default"},
+		Spec:       apis.KESExternalSecretSpec{BackendType: "secretsManager"},
+	}
+	testCases := []struct {
+		data apis.KESExternalSecretData
+		want string
+	}{
+		{apis.KESExternalSecretData{}, ""},
+		{apis.KESExternalSecretData{VersionStage: "AWSPREVIOUS"}, "AWSPREVIOUS"},
+		{apis.KESExternalSecretData{VersionId: "b1d2e3f4"}, "uuid/b1d2e3f4"},
+		{apis.KESExternalSecretData{VersionStage: "AWSCURRENT", VersionId: "b1d2e3f4"}, "uuid/b1d2e3f4"},
+		{apis.KESExternalSecretData{Version: "3"}, ""},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, parseVersion(K, tc.data, nil), tc.data)
+	}
+	K.Spec.BackendType = "gcpSecretsManager"
+	assert.Equal(t, "3", parseVersion(K, apis.KESExternalSecretData{Version: "3", VersionStage: "AWSPREVIOUS"}, nil))
+}
+
+func TestParseDataFromWithOptions(t *testing.T) {
+	K := apis.KESExternalSecret{}
+	err := yaml.Unmarshal([]byte(`apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: options
+  namespace: default
+spec:
+  backendType: secretsManager
+  dataFrom:
+    - demo-service/plain
+  dataFromWithOptions:
+    - key: demo-service/previous
+      versionStage: AWSPREVIOUS
+    - key: demo-service/pinned
+      versionId: b1d2e3f4
+      isBinary: true
+`), &K)
+	assert.NoError(t, err)
+	E, err := parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []api.ExternalSecretDataRemoteRef{
+		{Key: "demo-service/plain"},
+		{Key: "demo-service/previous", Version: "AWSPREVIOUS"},
+		{Key: "demo-service/pinned", Version: "uuid/b1d2e3f4"},
+	}, E.Spec.DataFrom)
+
+	K.Spec.BackendType = "vault"
+	_, err = parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{}, nil)
+	assert.EqualError(t, err, "isBinary on dataFromWithOptions demo-service/pinned can't be expressed by external-secrets.io/v1alpha1 dataFrom, use --eso-api-version=v1beta1 or v1")
+	_, err = parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{ESOAPIVersion: apis.ESOAPIVersionV1}, nil)
+	assert.NoError(t, err)
+	strategies, err := dataFromDecodingStrategies(K)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]string{2: "Base64"}, strategies)
+}
+
+func TestParseGeneralsBinary(t *testing.T) {
+	K := apis.KESExternalSecret{
+		Kind:       "ExternalSecret",
+		ApiVersion: "kubernetes-client.io/v1",
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "keystore",
+			Namespace: "default",
+		},
+		Spec: apis.KESExternalSecretSpec{
+			BackendType: "vault",
+			Data: []apis.KESExternalSecretData{
+				{Key: "secret/data/app", Name: "keystore.jks", Property: "keystore", IsBinary: true},
+				{Key: "secret/data/app", Name: "password", Property: "password"},
+				{Key: "secret/data/app", Name: "cert", Property: "cert", IsBinary: true},
+			},
+			Template: map[string]interface{}{
+				"stringData": map[string]interface{}{
+					"cert": "<%= data.cert %>",
+				},
+			},
+		},
+	}
+	E, err := parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"keystore.jks": `{{ ((index . "keystore.jks") | base64decode) | toString }}`,
+		"cert":         `{{ .cert | toString }}`,
+	}, E.Spec.Target.Template.Data)
+
+	K.Spec.BackendType = "secretsManager"
+	E, err = parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"cert": `{{ .cert | toString }}`}, E.Spec.Target.Template.Data)
+
+	// newer ESO versions decode through a decodingStrategy instead
+	K.Spec.BackendType = "vault"
+	E, err = parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{ESOAPIVersion: apis.ESOAPIVersionV1beta1}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"cert": `{{ .cert }}`}, E.Spec.Target.Template.Data)
+	strategies, err := decodingStrategies(K, E.Spec.Target.Template, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"keystore.jks": "Base64"}, strategies)
+
+	K.Spec.BackendType = "unknown"
+	_, err = parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{}, nil)
+	assert.EqualError(t, err, "isBinary on keystore.jks is not supported for backend unknown")
+	_, err = decodingStrategies(K, nil, nil)
+	assert.EqualError(t, err, "isBinary on keystore.jks is not supported for backend unknown")
+
+	K.Spec.BackendType = "systemManager"
+	K.Spec.Data = []apis.KESExternalSecretData{{Path: "/certs", IsBinary: true}}
+	_, err = parseGenerals(K, NewESOSecret(), &apis.KesToEsoOptions{}, nil)
+	assert.NoError(t, err)
+	refs := parsePaths(K, nil)
+	if assert.Len(t, refs, 1) {
+		assert.Equal(t, "Base64", refs[0].Find.DecodingStrategy)
+	}
+}
+
+func TestSplitByStore(t *testing.T) {
+	K := apis.KESExternalSecret{
+		Kind:       "ExternalSecret",
+		ApiVersion: "kubernetes-client.io/v1",
+		ObjectMeta: metav1.ObjectMeta{Name: "azure", Namespace: "default"},
+		Spec: apis.KESExternalSecretSpec{
+			BackendType:  "azureKeyVault",
+			KeyVaultName: "main",
+			Data: []apis.KESExternalSecretData{
+				{Key: "password", Name: "password", KeyVaultName: "Other"},
+				{Key: "username", Name: "username"},
+			},
+		},
+	}
+	splits := splitByStore(K, nil)
+	if assert.Len(t, splits, 2) {
+		assert.True(t, splits[0].Primary)
+		assert.Equal(t, "azure", splits[0].Kes.ObjectMeta.Name)
+		assert.Equal(t, "main", splits[0].Kes.Spec.KeyVaultName)
+		assert.Equal(t, []apis.KESExternalSecretData{{Key: "username", Name: "username"}}, splits[0].Kes.Spec.Data)
+		assert.False(t, splits[1].Primary)
+		assert.Equal(t, "azure-other", splits[1].Kes.ObjectMeta.Name)
+		assert.Equal(t, "azure", splits[1].Target)
+		assert.Equal(t, "Other", splits[1].Kes.Spec.KeyVaultName)
+	}
+
+	K.Spec.DataFrom = []string{"all"}
+	K.Spec.Data = []apis.KESExternalSecretData{{Key: "password", Name: "password", KeyVaultName: "other"}}
+	splits = splitByStore(K, nil)
+	if assert.Len(t, splits, 2) {
+		assert.Equal(t, "main", splits[0].Kes.Spec.KeyVaultName)
+		assert.Equal(t, []string{"all"}, splits[0].Kes.Spec.DataFrom)
+		assert.Empty(t, splits[0].Kes.Spec.Data)
+		assert.Equal(t, "other", splits[1].Kes.Spec.KeyVaultName)
+		assert.Empty(t, splits[1].Kes.Spec.DataFrom)
+	}
+
+	K.Spec.DataFrom = nil
+	splits = splitByStore(K, nil)
+	if assert.Len(t, splits, 1) {
+		assert.Equal(t, "azure", splits[0].Kes.ObjectMeta.Name)
+		assert.Equal(t, "other", splits[0].Kes.Spec.KeyVaultName)
+	}
+
+	K.Spec.Data = append(K.Spec.Data, apis.KESExternalSecretData{Key: "username", Name: "username"})
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(),
+		Options: &apis.KesToEsoOptions{ToStdout: true},
+	}
+	resp, _ := convertDocument(context.TODO(), &c, NewSecretStoreDB(), "azure.yaml", kesDocument{Kes: K})
+	if assert.Len(t, resp, 2) {
+		assert.Equal(t, api.ExternalSecretTarget{Name: "azure", Template: &api.ExternalSecretTemplate{}}, resp[0].Es.Spec.Target)
+		assert.Equal(t, "https://main.vault.azure.net", *resp[0].Ss.Spec.Provider.AzureKV.VaultURL)
+		assert.Equal(t, "azure-other", resp[1].Es.ObjectMeta.Name)
+		assert.Equal(t, api.ExternalSecretTarget{Name: "azure", CreationPolicy: api.Merge, Template: &api.ExternalSecretTemplate{}}, resp[1].Es.Spec.Target)
+		assert.Equal(t, "https://other.vault.azure.net", *resp[1].Ss.Spec.Provider.AzureKV.VaultURL)
+		assert.Equal(t, resp[1].Ss.ObjectMeta.Name, resp[1].Es.Spec.SecretStoreRef.Name)
+	}
+}
+
+func TestBindProviderVaultSharing(t *testing.T) {
+	stores := NewSecretStoreDB()
+	ctx := context.TODO()
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(),
+		Options: &apis.KesToEsoOptions{},
+	}
+	newKES := func(name string, role string) apis.KESExternalSecret {
+		return apis.KESExternalSecret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: apis.KESExternalSecretSpec{
+				BackendType:     "vault",
+				KvVersion:       2,
+				VaultMountPoint: "kubernetes",
+				VaultRole:       role,
+				Data: []apis.KESExternalSecretData{
+					{Key: "secret/data/app", Name: "password"},
+				},
+			},
+		}
+	}
+	first, _, created := bindProvider(ctx, utils.NewSecretStore(false), newKES("first", "app"), &c, stores, nil)
+	assert.True(t, created)
+	second, _, created := bindProvider(ctx, utils.NewSecretStore(false), newKES("second", "app"), &c, stores, nil)
+	assert.False(t, created)
+	assert.Equal(t, first.ObjectMeta.Name, second.ObjectMeta.Name)
+	other, _, created := bindProvider(ctx, utils.NewSecretStore(false), newKES("other", "admin"), &c, stores, nil)
+	assert.True(t, created)
+	assert.NotEqual(t, first.ObjectMeta.Name, other.ObjectMeta.Name)
+
+	assert.Equal(t, VaultStoreKey{AuthMount: "kubernetes", Role: "app", KVMount: "secret", KVVersion: api.VaultKVStoreV2}, vaultStoreKey(first))
+	assert.Regexp(t, "^vault-secretstore-autogen-[0-9a-f]{8}$", first.ObjectMeta.Name)
+	entries := stores.Entries()
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, []string{"default/first", "default/second"}, entries[0].Users)
+		assert.Equal(t, []string{"default/other"}, entries[1].Users)
+	}
+}
+
+func TestConvertDocumentInstances(t *testing.T) {
+	newDeployment := func(name string, env []corev1.EnvVar) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "kes-ns"},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "kubernetes-external-secrets", Env: env}},
+					},
+				},
+			},
+		}
+	}
+	secretRef := func(name string, key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Key:                  key,
+			},
+		}
+	}
+	options := apis.NewOptions()
+	options.Namespace = "kes-ns"
+	options.ToStdout = true
+	c := provider.KesToEsoClient{
+		Client: testclient.NewSimpleClientset(
+			newDeployment("kubernetes-external-secrets", []corev1.EnvVar{
+				{Name: "AWS_ACCESS_KEY_ID", ValueFrom: secretRef("default-aws", "id")},
+				{Name: "AWS_SECRET_ACCESS_KEY", ValueFrom: secretRef("default-aws", "secret")},
+			}),
+			newDeployment("kes-team-a", []corev1.EnvVar{
+				{Name: "INSTANCE_ID", Value: "team-a"},
+				{Name: "AWS_ACCESS_KEY_ID", ValueFrom: secretRef("team-a-aws", "id")},
+				{Name: "AWS_SECRET_ACCESS_KEY", ValueFrom: secretRef("team-a-aws", "secret")},
+			}),
+		),
+		Options: options,
+	}
+	instances, err := c.DiscoverKESInstances(context.TODO())
+	assert.NoError(t, err)
+	c.Instances = instances
+	K := apis.KESExternalSecret{
+		Kind:       "ExternalSecret",
+		ApiVersion: "kubernetes-client.io/v1",
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a-secret", Namespace: "team-a"},
+		Spec: apis.KESExternalSecretSpec{
+			BackendType:  "secretsManager",
+			ControllerId: "team-a",
+			Region:       "eu-west-1",
+			Data:         []apis.KESExternalSecretData{{Key: "team-a/credentials", Name: "password"}},
+		},
+	}
+	resp, _ := convertDocument(context.TODO(), &c, NewSecretStoreDB(), "team-a.yaml", kesDocument{Kes: K})
+	if assert.Len(t, resp, 1) {
+		assert.NoError(t, resp[0].Err)
+		assert.Equal(t, "team-a", resp[0].Ss.Spec.Controller)
+		assert.Equal(t, "team-a-aws", resp[0].Ss.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Name)
+	}
+	K.Spec.ControllerId = ""
+	resp, _ = convertDocument(context.TODO(), &c, NewSecretStoreDB(), "default.yaml", kesDocument{Kes: K})
+	if assert.Len(t, resp, 1) {
+		assert.Equal(t, "", resp[0].Ss.Spec.Controller)
+		assert.Equal(t, "default-aws", resp[0].Ss.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Name)
+	}
+}
+
+func TestStoreName(t *testing.T) {
+	S := utils.NewSecretStore(true)
+	S.ObjectMeta.Namespace = "team-a"
+	S.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{Service: api.AWSServiceSecretsManager, Region: "eu-west-1"}}
+	name, err := storeName(S, apis.ESOStoreExtensions{}, "secretsManager", "")
+	assert.NoError(t, err)
+	assert.Regexp(t, "^secretsmanager-secretstore-autogen-[0-9a-f]{8}$", name)
+	again, err := storeName(S, apis.ESOStoreExtensions{}, "secretsManager", DefaultStoreNameTemplate)
+	assert.NoError(t, err)
+	assert.Equal(t, name, again)
+
+	other := S
+	other.ObjectMeta.Namespace = "team-b"
+	otherName, err := storeName(other, apis.ESOStoreExtensions{}, "secretsManager", "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, name, otherName)
+	cluster := utils.NewSecretStore(false)
+	cluster.Spec = S.Spec
+	cluster.ObjectMeta.Namespace = "team-a"
+	clusterName, err := storeName(cluster, apis.ESOStoreExtensions{}, "secretsManager", "")
+	assert.NoError(t, err)
+	cluster.ObjectMeta.Namespace = "team-b"
+	otherClusterName, err := storeName(cluster, apis.ESOStoreExtensions{}, "secretsManager", "")
+	assert.NoError(t, err)
+	assert.Equal(t, clusterName, otherClusterName)
+
+	name, err = storeName(S, apis.ESOStoreExtensions{}, "secretsManager", "{{ .Namespace }}-aws")
+	assert.NoError(t, err)
+	assert.Equal(t, "team-a-aws", name)
+	_, err = storeName(S, apis.ESOStoreExtensions{}, "secretsManager", "{{ .Namespace }}_aws")
+	assert.Error(t, err)
+	assert.Error(t, ValidateStoreNameTemplate("{{ .Unknown }}"))
+	assert.Error(t, ValidateStoreNameTemplate("{{ .Hash"))
+	assert.NoError(t, ValidateStoreNameTemplate(DefaultStoreNameTemplate))
+}
+
+func TestBindProviderNameTemplateCollision(t *testing.T) {
+	stores := NewSecretStoreDB()
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(),
+		Options: &apis.KesToEsoOptions{StoreNameTemplate: "{{ .Backend }}"},
+	}
+	K := apis.KESExternalSecret{
+		ObjectMeta: metav1.ObjectMeta{Name: "first", Namespace: "default"},
+		Spec:       apis.KESExternalSecretSpec{BackendType: "secretsManager", Region: "eu-west-1"},
+	}
+	first, _, _ := bindProvider(context.TODO(), utils.NewSecretStore(false), K, &c, stores, nil)
+	assert.Equal(t, "secretsmanager", first.ObjectMeta.Name)
+	K.Spec.Region = "us-east-1"
+	second, _, _ := bindProvider(context.TODO(), utils.NewSecretStore(false), K, &c, stores, nil)
+	assert.Regexp(t, "^secretsmanager-[0-9a-f]{8}$", second.ObjectMeta.Name)
+}
+
+func TestRenderExternalSecret(t *testing.T) {
+	E := NewESOSecret()
+	E.ObjectMeta.Name = "ssm-path"
+	E.Spec.DataFrom = []api.ExternalSecretDataRemoteRef{{Key: "/demo-service/json"}}
+	got, err := renderExternalSecret(E, apis.ESOExtensions{}, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, E, got)
+
+	path := "/demo-service/config"
+	ext := apis.ESOExtensions{
+		DataFrom: []apis.ESODataFromRef{{Find: &apis.ESOFind{Path: &path}}},
+	}
+	got, err = renderExternalSecret(E, ext, "", nil)
+	assert.NoError(t, err)
+	dat, err := yaml.Marshal(got)
+	assert.NoError(t, err)
+	want := `apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  creationTimestamp: null
+  name: ssm-path
+spec:
+  dataFrom:
+  - extract:
+      key: /demo-service/json
+  - find:
+      path: /demo-service/config
+  secretStoreRef:
+    name: ""
+  target: {}
+status:
+  refreshTime: null
+`
+	assert.Equal(t, want, string(dat))
+}
+
+func TestRootReport(t *testing.T) {
+	ctx := context.TODO()
+	input := t.TempDir()
+	output := t.TempDir()
+	files := map[string]string{
+		"app.yaml": `apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: app
+  namespace: team-a
+spec:
+  backendType: secretsManager
+  region: eu-west-1
+  data:
+    - key: app/credentials
+      name: password
+      version: "3"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: not-kes
+`,
+		"broken.yaml": `apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: broken
+  namespace: team-a
+spec:
+  backendType: vault
+  data:
+    - path: /app
+      name: everything
+`,
+	}
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(input, name), []byte(content), 0644))
+	}
+	options := apis.NewOptions()
+	options.InputPath = input
+	options.OutputPath = output
+	options.ReuseClusterStores = false
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(),
+		Options: options,
+	}
+	_, rep := Root(ctx, &c)
+	assert.Equal(t, report.Summary{Files: 2, Documents: 3, Warnings: 1, Skipped: 1, Failed: 1}, rep.Summary)
+	if !assert.Len(t, rep.Files, 2) {
+		return
+	}
+	app := rep.Files[0]
+	assert.Equal(t, filepath.Join(input, "app.yaml"), app.Path)
+	assert.Equal(t, report.StatusWarnings, app.Status)
+	if assert.Len(t, app.Documents, 2) {
+		doc := app.Documents[0]
+		assert.Equal(t, "team-a/app", doc.Name)
+		assert.Equal(t, report.StatusWarnings, doc.Status)
+		assert.Equal(t, []string{"data.password.version"}, doc.Skipped)
+		codes := make([]report.Code, 0)
+		for _, warning := range doc.Warnings {
+			codes = append(codes, warning.Code)
+		}
+		assert.Contains(t, codes, report.CodeVersionIgnored)
+		if assert.Len(t, doc.Objects, 2) && assert.Len(t, doc.Bindings, 1) {
+			store := doc.Objects[0]
+			assert.Equal(t, "ClusterSecretStore", store.Kind)
+			assert.Equal(t, "external-secrets.io/v1alpha1", store.APIVersion)
+			assert.FileExists(t, store.Path)
+			assert.Equal(t, report.Object{
+				APIVersion: "external-secrets.io/v1alpha1",
+				Kind:       "ExternalSecret",
+				Name:       "app",
+				Namespace:  "team-a",
+				Path:       filepath.Join(output, "external-secret-app.yaml"),
+			}, doc.Objects[1])
+			assert.Equal(t, report.StoreBinding{
+				ExternalSecret: "team-a/app",
+				Kind:           "ClusterSecretStore",
+				Name:           store.Name,
+				Created:        true,
+			}, doc.Bindings[0])
+		}
+		assert.Equal(t, report.StatusSkipped, app.Documents[1].Status)
+	}
+	broken := rep.Files[1]
+	assert.Equal(t, report.StatusFailed, broken.Status)
+	if assert.Len(t, broken.Documents, 1) {
+		assert.Equal(t, "externalSecret with path selection is only supported for systemManager", broken.Documents[0].Error)
+	}
+}
+
+func TestRootStoreUsage(t *testing.T) {
+	input := t.TempDir()
+	kes := `apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: %v
+  namespace: apps
+spec:
+  backendType: vault
+  vaultMountPoint: kubernetes
+  vaultRole: %v
+  data:
+    - key: secret/data/%v
+      name: password
+`
+	for name, role := range map[string]string{"first": "apps", "second": "apps", "admin": "admin"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(input, name+".yaml"), []byte(fmt.Sprintf(kes, name, role, name)), 0644))
+	}
+	options := apis.NewOptions()
+	options.InputPath = input
+	options.OutputPath = t.TempDir()
+	options.ReuseClusterStores = false
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(),
+		Options: options,
+	}
+	_, rep := Root(context.TODO(), &c)
+	assert.Equal(t, 0, rep.Summary.Failed)
+	if !assert.Len(t, rep.Stores, 2) {
+		return
+	}
+	assert.Equal(t, []string{"apps/admin"}, rep.Stores[0].Users)
+	assert.Equal(t, []string{"apps/first", "apps/second"}, rep.Stores[1].Users)
+	assert.Equal(t, &report.VaultKey{
+		AuthMount: "kubernetes",
+		Role:      "apps",
+		KVMount:   "secret",
+		KVVersion: "v2",
+	}, rep.Stores[1].Vault)
+	for _, store := range rep.Stores {
+		assert.Equal(t, "ClusterSecretStore", store.Kind)
+		assert.Regexp(t, "^vault-secretstore-autogen-[0-9a-f]{8}$", store.Name)
+	}
+}
+
+func TestRootNoStore(t *testing.T) {
+	input := t.TempDir()
+	output := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(input, "kes.yaml"), []byte(`apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: unknown
+  namespace: apps
+spec:
+  backendType: keyWhiz
+  data:
+    - key: app/password
+      name: password
+---
+apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: nomount
+  namespace: apps
+spec:
+  backendType: vault
+  kvVersion: 2
+  data:
+    - key: /data/app
+      name: password
+`), 0644))
+	options := apis.NewOptions()
+	options.InputPath = input
+	options.OutputPath = output
+	options.ReuseClusterStores = false
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(),
+		Options: options,
+	}
+	_, rep := Root(context.TODO(), &c)
+	assert.Equal(t, report.Summary{Files: 1, Documents: 2, Failed: 2}, rep.Summary)
+	if assert.Len(t, rep.Files, 1) && assert.Len(t, rep.Files[0].Documents, 2) {
+		for _, doc := range rep.Files[0].Documents {
+			assert.Contains(t, doc.Error, "no SecretStore can be built")
+			assert.Empty(t, doc.Objects)
+			codes := make([]report.Code, 0)
+			for _, warning := range doc.Warnings {
+				codes = append(codes, warning.Code)
+			}
+			assert.Contains(t, codes, report.CodeNoStore)
+		}
+	}
+	written, err := os.ReadDir(output)
+	assert.NoError(t, err)
+	assert.Empty(t, written)
+}
+
+func TestRootESOAPIVersions(t *testing.T) {
+	ctx := context.TODO()
+	for _, version := range apis.ESOAPIVersions {
+		output := t.TempDir()
+		options := apis.NewOptions()
+		options.Namespace = "kes-ns"
+		options.InputPath = "testdata/versions/input"
+		options.OutputPath = output
+		options.ESOAPIVersion = version
+		c := provider.KesToEsoClient{
+			Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+			Options: options,
+		}
+		_, rep := Root(ctx, &c)
+		assert.Equal(t, 0, rep.Summary.Failed, version)
+		for _, file := range rep.Files {
+			for _, doc := range file.Documents {
+				for _, warning := range doc.Warnings {
+					assert.NotEqual(t, report.CodeProviderCredentials, warning.Code, "%v: %v", version, warning.Message)
+				}
+			}
+		}
+		golden := filepath.Join("testdata/versions", version)
+		got, err := os.ReadDir(output)
+		assert.NoError(t, err)
+		want, err := os.ReadDir(golden)
+		assert.NoError(t, err)
+		names := func(entries []os.DirEntry) []string {
+			ans := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				ans = append(ans, entry.Name())
+			}
+			return ans
+		}
+		if !assert.Equal(t, names(want), names(got), version) {
+			continue
+		}
+		for _, entry := range got {
+			gotFile, err := os.ReadFile(filepath.Join(output, entry.Name()))
+			assert.NoError(t, err)
+			wantFile, err := os.ReadFile(filepath.Join(golden, entry.Name()))
+			assert.NoError(t, err)
+			assert.Equal(t, string(wantFile), string(gotFile), "%v: %v", version, entry.Name())
+		}
+	}
+}
+
+func TestRootDataFromDecodingStrategy(t *testing.T) {
+	ctx := context.TODO()
+	for _, version := range []string{apis.ESOAPIVersionV1alpha1, apis.ESOAPIVersionV1} {
+		output := t.TempDir()
+		options := apis.NewOptions()
+		options.Namespace = "kes-ns"
+		options.InputPath = "testdata/datafrom-binary/input"
+		options.OutputPath = output
+		options.ESOAPIVersion = version
+		c := provider.KesToEsoClient{
+			Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+			Options: options,
+		}
+		_, rep := Root(ctx, &c)
+		if version == apis.ESOAPIVersionV1alpha1 {
+			assert.Equal(t, 1, rep.Summary.Failed)
+			continue
+		}
+		assert.Equal(t, 0, rep.Summary.Failed)
+		got, err := os.ReadFile(filepath.Join(output, "external-secret-keystores.yaml"))
+		assert.NoError(t, err)
+		want, err := os.ReadFile("testdata/datafrom-binary/v1/external-secret-keystores.yaml")
+		assert.NoError(t, err)
+		assert.Equal(t, string(want), string(got))
+	}
+}
+
+func TestRootVaultMixedMounts(t *testing.T) {
+	ctx := context.TODO()
+	input := t.TempDir()
+	err := os.WriteFile(filepath.Join(input, "vault.yaml"), []byte(`apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: mixed
+  namespace: apps
+spec:
+  backendType: vault
+  vaultMountPoint: kubernetes
+  vaultRole: apps
+  data:
+    - key: secret/data/apps/db
+      name: password
+  dataFromWithOptions:
+    - key: other/data/apps/config
+---
+apiVersion: kubernetes-client.io/v1
+kind: ExternalSecret
+metadata:
+  name: single
+  namespace: apps
+spec:
+  backendType: vault
+  vaultMountPoint: kubernetes
+  vaultRole: apps
+  data:
+    - key: secret/data/apps/db
+      name: password
+`), 0644)
+	assert.NoError(t, err)
+	options := apis.NewOptions()
+	options.Namespace = "kes-ns"
+	options.InputPath = input
+	options.OutputPath = t.TempDir()
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+		Options: options,
+	}
+	_, rep := Root(ctx, &c)
+	assert.Equal(t, 1, rep.Summary.Failed)
+	assert.Equal(t, 1, rep.Summary.Converted+rep.Summary.Warnings)
+	if assert.Len(t, rep.Files, 1) && assert.Len(t, rep.Files[0].Documents, 2) {
+		assert.Equal(t, "keys read from several KV mounts, secret and other, a Vault SecretStore has a single one", rep.Files[0].Documents[0].Error)
+	}
+}
+
+func TestRootKustomizeLayout(t *testing.T) {
+	ctx := context.TODO()
+	output := t.TempDir()
+	options := apis.NewOptions()
+	options.Namespace = "kes-ns"
+	options.InputPath = "testdata/versions/input"
+	options.OutputPath = output
+	options.OutputLayout = apis.OutputLayoutKustomize
+	options.StoresComponent = true
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+		Options: options,
+	}
+	_, rep := Root(ctx, &c)
+	assert.Equal(t, 0, rep.Summary.Failed)
+	readKustomization := func(dir string) utils.Kustomization {
+		dat, err := os.ReadFile(filepath.Join(output, dir, "kustomization.yaml"))
+		assert.NoError(t, err)
+		kustomization := utils.Kustomization{}
+		assert.NoError(t, yaml.Unmarshal(dat, &kustomization))
+		return kustomization
+	}
+	assert.Equal(t, utils.Kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Resources:  []string{"apps"},
+		Components: []string{"stores"},
+	}, readKustomization(""))
+	apps := readKustomization("apps")
+	assert.Equal(t, "Kustomization", apps.Kind)
+	assert.Equal(t, []string{
+		"external-secret-akeyless.yaml",
+		"external-secret-alicloud.yaml",
+		"external-secret-aws.yaml",
+		"external-secret-ssm.yaml",
+		"external-secret-vault.yaml",
+	}, apps.Resources)
+	stores := readKustomization("stores")
+	assert.Equal(t, "Component", stores.Kind)
+	assert.Contains(t, stores.Resources, "secret-store-vault-secretstore-autogen-7b7089cc.yaml")
+	assert.Contains(t, stores.Resources, "secret-akeyless-provider-akeyless-secrets.yaml")
+
+	// Files and directories kestoeso didn't write are left out.
+	assert.NoError(t, os.MkdirAll(filepath.Join(output, "overlays", "prod"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(output, "overlays", "prod", "kustomization.yaml"), []byte("resources:\n- ../..\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(output, "overlays", "patch.yaml"), []byte("kind: ExternalSecret\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(output, "apps", "notes.yaml"), []byte("notes: true\n"), 0644))
+
+	// A second run finds the stores in the stores directory.
+	_, rep = Root(ctx, &c)
+	bindings := 0
+	for _, file := range rep.Files {
+		for _, doc := range file.Documents {
+			for _, binding := range doc.Bindings {
+				assert.False(t, binding.Created, binding.Name)
+				bindings++
+			}
+		}
+	}
+	assert.Equal(t, 5, bindings)
+	assert.Equal(t, stores, readKustomization("stores"))
+	assert.Equal(t, apps, readKustomization("apps"))
+	assert.Equal(t, []string{"apps"}, readKustomization("").Resources)
+	assert.NoFileExists(t, filepath.Join(output, "overlays", "kustomization.yaml"))
+}
+
+func TestRootHelmLayout(t *testing.T) {
+	ctx := context.TODO()
+	output := t.TempDir()
+	options := apis.NewOptions()
+	options.Namespace = "kes-ns"
+	options.InputPath = "testdata/versions/input"
+	options.OutputPath = output
+	options.OutputLayout = apis.OutputLayoutHelm
+	options.ESOAPIVersion = apis.ESOAPIVersionV1
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+		Options: options,
+	}
+	_, rep := Root(ctx, &c)
+	assert.Equal(t, 0, rep.Summary.Failed)
+	leftOut := 0
+	for _, warning := range rep.Warnings {
+		assert.NotEqual(t, report.CodeHelmChart, warning.Code, warning.Message)
+		if warning.Code == report.CodeHelmCredentials {
+			leftOut++
+		}
+	}
+	// Static credentials stay out of the chart unless asked for.
+	assert.Equal(t, 2, leftOut)
+	_, err := os.Stat(filepath.Join(output, "templates/secret-akeyless-provider-akeyless-secrets.yaml"))
+	assert.True(t, os.IsNotExist(err))
+	err = filepath.WalkDir("testdata/helm", func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		name, _ := filepath.Rel("testdata/helm", path)
+		want, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(output, name))
+		assert.NoError(t, err)
+		assert.Equal(t, string(want), string(got), name)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// Values edited by hand are kept by later runs.
+	values, err := os.ReadFile(filepath.Join(output, "values.yaml"))
+	assert.NoError(t, err)
+	edited := strings.Replace(string(values), "refreshInterval: 1h", "refreshInterval: 5m", 1)
+	assert.NoError(t, os.WriteFile(filepath.Join(output, "values.yaml"), []byte(edited), 0644))
+	_, rep = Root(ctx, &c)
+	assert.Equal(t, 0, rep.Summary.Failed)
+	values, err = os.ReadFile(filepath.Join(output, "values.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, edited, string(values))
+	want, err := os.ReadFile("testdata/helm/templates/external-secret-vault.yaml")
+	assert.NoError(t, err)
+	got, err := os.ReadFile(filepath.Join(output, "templates/external-secret-vault.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestRootHelmCredentialValues(t *testing.T) {
+	ctx := context.TODO()
+	output := t.TempDir()
+	options := apis.NewOptions()
+	options.Namespace = "kes-ns"
+	options.InputPath = "testdata/versions/input"
+	options.OutputPath = output
+	options.OutputLayout = apis.OutputLayoutHelm
+	options.ESOAPIVersion = apis.ESOAPIVersionV1
+	options.HelmCredentialValues = true
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+		Options: options,
+	}
+	_, rep := Root(ctx, &c)
+	assert.Equal(t, 0, rep.Summary.Failed)
+	for _, warning := range rep.Warnings {
+		assert.NotEqual(t, report.CodeHelmCredentials, warning.Code, warning.Message)
+	}
+	values, err := os.ReadFile(filepath.Join(output, "values.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(values), "kes-ns/akeyless-secrets:")
+	assert.Contains(t, string(values), "access-id: p-123456")
+	secret, err := os.ReadFile(filepath.Join(output, "templates/secret-akeyless-provider-akeyless-secrets.yaml"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(secret), `access-id: {{ index .Values "credentials" "kes-ns/akeyless-secrets" "access-id" | quote }}`)
+}
+
+
+func TestRootWorkers(t *testing.T) {
+	ctx := context.TODO()
+	run := func(workers int) ([]RootResponse, report.Report) {
+		options := apis.NewOptions()
+		options.Namespace = "kes-ns"
+		options.InputPath = "testdata/versions/input"
+		options.OutputPath = t.TempDir()
+		options.Workers = workers
+		c := provider.KesToEsoClient{
+			Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+			Options: options,
+		}
+		return Root(ctx, &c)
+	}
+	names := func(responses []RootResponse) []string {
+		ans := make([]string, 0, len(responses))
+		for _, response := range responses {
+			ans = append(ans, response.Kes.ObjectMeta.Namespace+"/"+response.Kes.ObjectMeta.Name)
+		}
+		return ans
+	}
+	sequential, sequentialReport := run(1)
+	assert.True(t, sort.StringsAreSorted(names(sequential)))
+	for i := 0; i < 5; i++ {
+		concurrent, concurrentReport := run(16)
+		assert.Equal(t, names(sequential), names(concurrent))
+		for j := range concurrentReport.Files {
+			for k := range concurrentReport.Files[j].Documents {
+				for l := range concurrentReport.Files[j].Documents[k].Objects {
+					// Paths are in another output directory.
+					concurrentReport.Files[j].Documents[k].Objects[l].Path = sequentialReport.Files[j].Documents[k].Objects[l].Path
+				}
+			}
+		}
+		assert.Equal(t, sequentialReport, concurrentReport)
+	}
+}
+
+func TestRootUnwritableOutput(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "output")
+	assert.NoError(t, os.WriteFile(output, []byte("not a directory"), 0644))
+	options := apis.NewOptions()
+	options.Namespace = "kes-ns"
+	options.InputPath = "testdata/versions/input"
+	options.OutputPath = output
+	options.Workers = 4
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(newBackendsDeployment()),
+		Options: options,
+	}
+	responses, rep := Root(context.TODO(), &c)
+	assert.NotZero(t, rep.Summary.Documents)
+	assert.Equal(t, rep.Summary.Documents, rep.Summary.Failed)
+	for _, response := range responses {
+		assert.Error(t, response.Err)
+	}
+	for _, file := range rep.Files {
+		for _, doc := range file.Documents {
+			assert.Equal(t, report.StatusFailed, doc.Status)
+			assert.Contains(t, doc.Error, output)
+		}
+	}
+}
+
+func TestRootKESEnvProblems(t *testing.T) {
+	deployment := newBackendsDeployment()
+	container := &deployment.Spec.Template.Spec.Containers[0]
+	container.EnvFrom = []corev1.EnvFromSource{
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "kes-env"}}},
+	}
+	options := apis.NewOptions()
+	options.Namespace = "kes-ns"
+	options.InputPath = "testdata/versions/input"
+	options.OutputPath = t.TempDir()
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(deployment),
+		Options: options,
+	}
+	_, rep := Root(context.TODO(), &c)
+	warnings := make([]string, 0)
+	for _, warning := range rep.Warnings {
+		if warning.Code == report.CodeKESEnv {
+			warnings = append(warnings, warning.Message)
+		}
+	}
+	if assert.Len(t, warnings, 1) {
+		assert.Contains(t, warnings[0], "KES Deployment kes-ns/kubernetes-external-secrets: envFrom Secret kes-env could not be read")
+	}
+}
@@ -0,0 +1,448 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"kestoeso/pkg/apis"
+	"kestoeso/pkg/provider"
+	"kestoeso/pkg/report"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	yaml "sigs.k8s.io/yaml"
+)
+
+// Store DB Functions
+
+// StoreEntry is a SecretStore along with the providers that
+// external-secrets.io/v1alpha1 can't hold.
+type StoreEntry struct {
+	Store  api.SecretStore
+	Ext    apis.ESOStoreExtensions
+	Users  []string // KES ExternalSecrets using the store, as namespace/name
+	Source string   // where an existing store was loaded from, empty for new stores
+	// Unsupported lists the provider fields of an existing store that the
+	// v1alpha1 model can't hold. Such stores are never reused.
+	Unsupported []string
+}
+
+// StoreDB keeps track of the stores of a run, so that every KES
+// ExternalSecret needing the same store shares it.
+type StoreDB interface {
+	// Add registers an existing store.
+	Add(entry StoreEntry)
+	// Bind returns the store matching S and ext, registering S when none
+	// does, and records user as one of its users. created tells whether S
+	// was registered, under another name if its name was already taken.
+	Bind(S api.SecretStore, ext apis.ESOStoreExtensions, user string) (entry StoreEntry, created bool)
+	// Entries returns every store, in the order they were registered.
+	Entries() []StoreEntry
+}
+
+// SecretStoreDB is a StoreDB safe for concurrent use.
+type SecretStoreDB struct {
+	mu      sync.Mutex
+	entries []StoreEntry
+}
+
+func NewSecretStoreDB() *SecretStoreDB {
+	return &SecretStoreDB{entries: make([]StoreEntry, 0)}
+}
+
+func (storedb *SecretStoreDB) Add(entry StoreEntry) {
+	storedb.mu.Lock()
+	defer storedb.mu.Unlock()
+	storedb.entries = append(storedb.entries, entry)
+}
+
+func (storedb *SecretStoreDB) Bind(S api.SecretStore, ext apis.ESOStoreExtensions, user string) (StoreEntry, bool) {
+	storedb.mu.Lock()
+	defer storedb.mu.Unlock()
+	exists, pos := storedb.exists(S, ext)
+	if exists {
+		storedb.entries[pos].Users = append(storedb.entries[pos].Users, user)
+		return storedb.entries[pos], false
+	}
+	if storedb.nameTaken(S) {
+		hash, _ := storeHash(S, ext)
+		S.ObjectMeta.Name = fmt.Sprintf("%v-%v", S.ObjectMeta.Name, hash)
+	}
+	entry := StoreEntry{Store: S, Ext: ext, Users: []string{user}}
+	storedb.entries = append(storedb.entries, entry)
+	return entry, true
+}
+
+func (storedb *SecretStoreDB) Entries() []StoreEntry {
+	storedb.mu.Lock()
+	defer storedb.mu.Unlock()
+	ans := make([]StoreEntry, len(storedb.entries))
+	copy(ans, storedb.entries)
+	return ans
+}
+
+func (storedb *SecretStoreDB) exists(S api.SecretStore, ext apis.ESOStoreExtensions) (bool, int) {
+	for idx, entry := range storedb.entries {
+		secretStore := entry.Store
+		if len(entry.Unsupported) > 0 || !reflect.DeepEqual(entry.Ext, ext) {
+			continue
+		}
+		if S.Kind == "SecretStore" &&
+			secretStore.Namespace == S.Namespace &&
+			secretStore.APIVersion == S.APIVersion &&
+			secretStore.Kind == S.Kind &&
+			sameSpec(secretStore, S) {
+			return true, idx
+		} else if S.Kind == "ClusterSecretStore" &&
+			secretStore.APIVersion == S.APIVersion &&
+			secretStore.Kind == S.Kind &&
+			sameSpec(secretStore, S) {
+			return true, idx
+		}
+	}
+	return false, -1
+}
+
+// sameSpec tells whether a and b read the same way. Vault stores only
+// compare their VaultStoreKey and controller class.
+func sameSpec(a, b api.SecretStore) bool {
+	if isVaultStore(a) && isVaultStore(b) {
+		return vaultStoreKey(a) == vaultStoreKey(b) && a.Spec.Controller == b.Spec.Controller
+	}
+	return reflect.DeepEqual(a.Spec, b.Spec)
+}
+
+// nameTaken tells whether another store already uses the name of S.
+func (storedb *SecretStoreDB) nameTaken(S api.SecretStore) bool {
+	for _, entry := range storedb.entries {
+		secretStore := entry.Store
+		if secretStore.ObjectMeta.Name != S.ObjectMeta.Name || secretStore.Kind != S.Kind {
+			continue
+		}
+		if S.Kind == "ClusterSecretStore" || secretStore.Namespace == S.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// storeFromObject reads an ESO SecretStore or ClusterSecretStore manifest
+// of any ESO API version into the v1alpha1 model used while converting.
+// ok is false for any other object.
+func storeFromObject(obj map[string]interface{}) (entry StoreEntry, ok bool, err error) {
+	kind, _ := obj["kind"].(string)
+	apiVersion, _ := obj["apiVersion"].(string)
+	if (kind != "SecretStore" && kind != "ClusterSecretStore") || !strings.HasPrefix(apiVersion, "external-secrets.io/") {
+		return entry, false, nil
+	}
+	dat, err := json.Marshal(obj)
+	if err != nil {
+		return entry, false, err
+	}
+	err = json.Unmarshal(dat, &entry.Store)
+	if err != nil {
+		return entry, false, err
+	}
+	entry.Store.TypeMeta.APIVersion = "external-secrets.io/v1alpha1"
+	// Fields only known to the cluster would keep loaded stores from
+	// matching generated ones.
+	entry.Store.ObjectMeta = metav1.ObjectMeta{
+		Name:      entry.Store.ObjectMeta.Name,
+		Namespace: entry.Store.ObjectMeta.Namespace,
+	}
+	entry.Store.Status = api.SecretStoreStatus{}
+	spec, _ := obj["spec"].(map[string]interface{})
+	providers, _ := spec["provider"].(map[string]interface{})
+	if akeyless, ok := providers["akeyless"]; ok {
+		dat, err := json.Marshal(akeyless)
+		if err != nil {
+			return entry, false, err
+		}
+		entry.Ext.Akeyless = &apis.ESOAkeylessProvider{}
+		err = json.Unmarshal(dat, entry.Ext.Akeyless)
+		if err != nil {
+			return entry, false, err
+		}
+	}
+	// Stores written for newer ESO versions may use provider fields that
+	// were dropped above; reusing them would ignore those fields.
+	original := map[string]interface{}{}
+	flattenFields("", providers, original)
+	read, err := providerFields(entry.Store, entry.Ext)
+	if err != nil {
+		return entry, false, err
+	}
+	for _, field := range sortedKeys(original) {
+		if !reflect.DeepEqual(original[field], read[field]) {
+			entry.Unsupported = append(entry.Unsupported, field)
+		}
+	}
+	return entry, true, nil
+}
+
+// providerFields flattens the provider of a store into a map of JSON paths,
+// such as aws.auth.secretRef.accessKeyIDSecretRef.name, to their values. The
+// controller class of the store is kept under controller.
+func providerFields(S api.SecretStore, ext apis.ESOStoreExtensions) (map[string]interface{}, error) {
+	providers := map[string]interface{}{}
+	if S.Spec.Provider != nil {
+		dat, err := json.Marshal(S.Spec.Provider)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(dat, &providers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ext.Akeyless != nil {
+		dat, err := json.Marshal(ext.Akeyless)
+		if err != nil {
+			return nil, err
+		}
+		akeyless := map[string]interface{}{}
+		err = json.Unmarshal(dat, &akeyless)
+		if err != nil {
+			return nil, err
+		}
+		providers["akeyless"] = akeyless
+	}
+	ans := map[string]interface{}{}
+	flattenFields("", providers, ans)
+	if S.Spec.Controller != "" {
+		ans["controller"] = S.Spec.Controller
+	}
+	return ans, nil
+}
+
+// flattenFields adds the leaves of v to out, skipping empty values.
+func flattenFields(prefix string, v interface{}, out map[string]interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenFields(key, child, out)
+		}
+	case []interface{}:
+		for idx, child := range value {
+			flattenFields(fmt.Sprintf("%v[%v]", prefix, idx), child, out)
+		}
+	case nil:
+	case string:
+		if value != "" {
+			out[prefix] = value
+		}
+	default:
+		out[prefix] = value
+	}
+}
+
+// diffFields returns the sorted paths whose values differ between a and b.
+func diffFields(a, b map[string]interface{}) []string {
+	ans := make([]string, 0)
+	for key, value := range a {
+		if !reflect.DeepEqual(value, b[key]) {
+			ans = append(ans, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			ans = append(ans, key)
+		}
+	}
+	sort.Strings(ans)
+	return ans
+}
+
+// authField tells whether a provider field sets how ESO authenticates or
+// which ESO instance uses the store, rather than what the store reads.
+func authField(field string) bool {
+	for _, segment := range strings.Split(field, ".") {
+		segment = strings.ToLower(segment)
+		if strings.Contains(segment, "auth") || segment == "role" || segment == "identityid" || segment == "controller" {
+			return true
+		}
+	}
+	return false
+}
+
+// NearMatch is an existing store reading from the same place as a generated
+// one, which could not be reused because of Fields.
+type NearMatch struct {
+	Entry  StoreEntry
+	Fields []string
+}
+
+// nearMatches returns the existing stores that only differ from entry in
+// their authentication, their kind, or fields the v1alpha1 model can't hold.
+func nearMatches(stores StoreDB, entry StoreEntry) []NearMatch {
+	ans := make([]NearMatch, 0)
+	fields, err := providerFields(entry.Store, entry.Ext)
+	if err != nil {
+		return ans
+	}
+	S := entry.Store
+	for _, candidate := range stores.Entries() {
+		C := candidate.Store
+		if candidate.Source == "" {
+			continue
+		}
+		// a SecretStore is only usable from its own namespace
+		if C.Kind == "SecretStore" && (S.Kind != "SecretStore" || C.ObjectMeta.Namespace != S.ObjectMeta.Namespace) {
+			continue
+		}
+		candidateFields, err := providerFields(C, candidate.Ext)
+		if err != nil {
+			continue
+		}
+		diff := diffFields(fields, candidateFields)
+		near := true
+		for _, field := range diff {
+			if !authField(field) {
+				near = false
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if C.Kind != S.Kind {
+			diff = append(diff, "kind")
+		}
+		diff = append(diff, candidate.Unsupported...)
+		if len(diff) > 0 {
+			ans = append(ans, NearMatch{Entry: candidate, Fields: diff})
+		}
+	}
+	return ans
+}
+
+// reportNearMatches warns about existing stores that could replace a
+// generated one after a review.
+func reportNearMatches(stores StoreDB, entry StoreEntry, rep *report.Log) {
+	for _, match := range nearMatches(stores, entry) {
+		C := match.Entry.Store
+		rep.Warnf(report.CodeStoreNearMatch, "%v %v, loaded from %v, reads from the same provider as the generated %v %v but differs in %v. Point the ExternalSecret to it by hand if these differences don't matter",
+			C.Kind, C.ObjectMeta.Name, match.Entry.Source, entry.Store.Kind, entry.Store.ObjectMeta.Name, strings.Join(match.Fields, ", "))
+	}
+}
+
+// LoadStoresFromDir registers the stores found in the manifests of dir and
+// its subdirectories, such as the output of an earlier run. Other objects are
+// ignored.
+func LoadStoresFromDir(stores StoreDB, dir string) error {
+	return filepath.WalkDir(dir, func(path string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			return nil
+		}
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		docs, err := splitDocuments(dat)
+		if err != nil {
+			return fmt.Errorf("could not read %v: %w", path, err)
+		}
+		for _, doc := range docs {
+			obj := map[string]interface{}{}
+			err = yaml.Unmarshal(doc, &obj)
+			if err != nil {
+				return fmt.Errorf("could not read %v: %w", path, err)
+			}
+			entry, ok, err := storeFromObject(obj)
+			if err != nil {
+				return fmt.Errorf("could not read %v: %w", path, err)
+			}
+			if ok {
+				entry.Source = path
+				stores.Add(entry)
+			}
+		}
+		return nil
+	})
+}
+
+// LoadStoresFromCluster registers the SecretStores and ClusterSecretStores
+// already applied to the cluster.
+func LoadStoresFromCluster(ctx context.Context, stores StoreDB, client *provider.KesToEsoClient) error {
+	objects, err := client.ListESOStores(ctx)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		entry, ok, err := storeFromObject(obj)
+		if err != nil {
+			return err
+		}
+		if ok {
+			entry.Source = "cluster"
+			stores.Add(entry)
+		}
+	}
+	return nil
+}
+
+// storeSource returns where the store S was loaded from, if it existed
+// before the run.
+func storeSource(stores StoreDB, S api.SecretStore) string {
+	for _, entry := range stores.Entries() {
+		C := entry.Store
+		if C.Kind != S.Kind || C.ObjectMeta.Name != S.ObjectMeta.Name {
+			continue
+		}
+		if S.Kind == "ClusterSecretStore" || C.ObjectMeta.Namespace == S.ObjectMeta.Namespace {
+			return entry.Source
+		}
+	}
+	return ""
+}
+
+// reportStoreUsage lists which KES ExternalSecrets share each store.
+func reportStoreUsage(stores StoreDB, rep *report.Report) {
+	for _, entry := range stores.Entries() {
+		if len(entry.Users) == 0 {
+			continue
+		}
+		S := entry.Store
+		store := report.Store{
+			Kind:   S.Kind,
+			Name:   S.ObjectMeta.Name,
+			Source: entry.Source,
+			Users:  entry.Users,
+		}
+		if S.Kind == "SecretStore" {
+			store.Namespace = S.ObjectMeta.Namespace
+		}
+		description := ""
+		if isVaultStore(S) {
+			key := vaultStoreKey(S)
+			store.Vault = &report.VaultKey{
+				Server:    key.Server,
+				AuthMount: key.AuthMount,
+				Role:      key.Role,
+				KVMount:   key.KVMount,
+				KVVersion: string(key.KVVersion),
+			}
+			description = fmt.Sprintf(" (%v)", key)
+		}
+		if entry.Source != "" {
+			description += fmt.Sprintf(", loaded from %v,", entry.Source)
+		}
+		log.Infof("%v %v%v is used by %v", S.Kind, S.ObjectMeta.Name, description, strings.Join(entry.Users, ", "))
+		rep.Stores = append(rep.Stores, store)
+	}
+}
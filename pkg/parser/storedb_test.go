@@ -0,0 +1,335 @@
+package parser
+
+import (
+	"context"
+	"fmt"
+	"kestoeso/pkg/apis"
+	"kestoeso/pkg/provider"
+	"kestoeso/pkg/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
+	esmeta "github.com/external-secrets/external-secrets/apis/meta/v1"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newAWSStore(region string) api.SecretStore {
+	S := utils.NewSecretStore(false)
+	S.ObjectMeta.Name = "aws-" + region
+	S.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{Service: api.AWSServiceSecretsManager, Region: region}}
+	return S
+}
+
+func TestSecretStoreDBBind(t *testing.T) {
+	stores := NewSecretStoreDB()
+	entry, created := stores.Bind(newAWSStore("eu-west-1"), apis.ESOStoreExtensions{}, "default/first")
+	assert.True(t, created)
+	assert.Equal(t, "aws-eu-west-1", entry.Store.ObjectMeta.Name)
+	entry, created = stores.Bind(newAWSStore("eu-west-1"), apis.ESOStoreExtensions{}, "default/second")
+	assert.False(t, created)
+	assert.Equal(t, []string{"default/first", "default/second"}, entry.Users)
+
+	other := newAWSStore("us-east-1")
+	other.ObjectMeta.Name = "aws-eu-west-1"
+	entry, created = stores.Bind(other, apis.ESOStoreExtensions{}, "default/third")
+	assert.True(t, created)
+	assert.Regexp(t, "^aws-eu-west-1-[0-9a-f]{8}$", entry.Store.ObjectMeta.Name)
+
+	akeyless := newAWSStore("eu-west-1")
+	akeyless.Spec.Provider = &api.SecretStoreProvider{}
+	url := "https://api.akeyless.io"
+	_, created = stores.Bind(akeyless, apis.ESOStoreExtensions{Akeyless: &apis.ESOAkeylessProvider{AkeylessGWApiURL: &url}}, "default/fourth")
+	assert.True(t, created)
+	assert.Len(t, stores.Entries(), 3)
+}
+
+func TestSecretStoreDBBindVaultKey(t *testing.T) {
+	newVaultStore := func(role string, serviceAccount string) api.SecretStore {
+		S := utils.NewSecretStore(false)
+		S.ObjectMeta.Name = "vault-" + role
+		S.Spec.Provider = &api.SecretStoreProvider{Vault: &api.VaultProvider{
+			Server:  "https://vault:8200",
+			Path:    "secret",
+			Version: api.VaultKVStoreV2,
+			Auth: api.VaultAuth{Kubernetes: &api.VaultKubernetesAuth{
+				Path:              "kubernetes",
+				Role:              role,
+				ServiceAccountRef: &esmeta.ServiceAccountSelector{Name: serviceAccount},
+			}},
+		}}
+		return S
+	}
+	stores := NewSecretStoreDB()
+	_, created := stores.Bind(newVaultStore("app", "kes"), apis.ESOStoreExtensions{}, "default/first")
+	assert.True(t, created)
+	// only the VaultStoreKey tells Vault stores apart
+	entry, created := stores.Bind(newVaultStore("app", "other"), apis.ESOStoreExtensions{}, "default/second")
+	assert.False(t, created)
+	assert.Equal(t, []string{"default/first", "default/second"}, entry.Users)
+	_, created = stores.Bind(newVaultStore("admin", "kes"), apis.ESOStoreExtensions{}, "default/third")
+	assert.True(t, created)
+}
+
+func TestSecretStoreDBConcurrentBind(t *testing.T) {
+	stores := NewSecretStoreDB()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stores.Bind(newAWSStore(fmt.Sprintf("region-%v", i%5)), apis.ESOStoreExtensions{}, fmt.Sprintf("default/kes-%v", i))
+		}(i)
+	}
+	wg.Wait()
+	entries := stores.Entries()
+	assert.Len(t, entries, 5)
+	users := 0
+	for _, entry := range entries {
+		users += len(entry.Users)
+	}
+	assert.Equal(t, 50, users)
+}
+
+func TestStoreFromObject(t *testing.T) {
+	_, ok, err := storeFromObject(map[string]interface{}{"apiVersion": "v1", "kind": "Secret"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	entry, ok, err := storeFromObject(map[string]interface{}{
+		"apiVersion": "external-secrets.io/v1beta1",
+		"kind":       "ClusterSecretStore",
+		"metadata": map[string]interface{}{
+			"name":            "akeyless",
+			"resourceVersion": "42",
+		},
+		"spec": map[string]interface{}{
+			"provider": map[string]interface{}{
+				"akeyless": map[string]interface{}{
+					"akeylessGWApiURL": "https://api.akeyless.io",
+				},
+			},
+		},
+		"status": map[string]interface{}{
+			"conditions": []interface{}{map[string]interface{}{"type": "Ready", "status": "True"}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "external-secrets.io/v1alpha1", entry.Store.APIVersion)
+	assert.Equal(t, "akeyless", entry.Store.ObjectMeta.Name)
+	assert.Equal(t, "", entry.Store.ObjectMeta.ResourceVersion)
+	assert.Empty(t, entry.Store.Status.Conditions)
+	if assert.NotNil(t, entry.Ext.Akeyless) {
+		assert.Equal(t, "https://api.akeyless.io", *entry.Ext.Akeyless.AkeylessGWApiURL)
+	}
+}
+
+func TestRootReusesOutputStores(t *testing.T) {
+	ctx := context.TODO()
+	output := t.TempDir()
+	options := apis.NewOptions()
+	options.InputPath = "testdata/aws-secretsmanager.golden"
+	options.OutputPath = output
+	c := provider.KesToEsoClient{
+		Client:  testclient.NewSimpleClientset(),
+		Options: options,
+	}
+	resp, _ := Root(ctx, &c)
+	if !assert.Len(t, resp, 1) || !assert.NoError(t, resp[0].Err) {
+		return
+	}
+	storeFile := filepath.Join(output, fmt.Sprintf("secret-store-%v.yaml", resp[0].Ss.ObjectMeta.Name))
+	assert.FileExists(t, storeFile)
+
+	// a store renamed by hand is reused rather than generated again
+	dat, err := os.ReadFile(storeFile)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(storeFile))
+	renamed := []byte(strings.Replace(string(dat), resp[0].Ss.ObjectMeta.Name, "shared-aws", 1))
+	assert.NoError(t, os.WriteFile(filepath.Join(output, "stores.yaml"), renamed, 0644))
+	resp, _ = Root(ctx, &c)
+	if assert.Len(t, resp, 1) {
+		assert.Equal(t, "shared-aws", resp[0].Es.Spec.SecretStoreRef.Name)
+	}
+	assert.NoFileExists(t, storeFile)
+
+	options.ReuseOutputStores = false
+	resp, _ = Root(ctx, &c)
+	if assert.Len(t, resp, 1) {
+		assert.NotEqual(t, "shared-aws", resp[0].Es.Spec.SecretStoreRef.Name)
+	}
+	assert.FileExists(t, storeFile)
+}
+
+// newESOStoresClient serves stores as an ESO release without the v1 API.
+func newESOStoresClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{}
+	for _, version := range provider.ESOStoreVersions {
+		listKinds[schema.GroupVersionResource{Group: "external-secrets.io", Version: version, Resource: "secretstores"}] = "SecretStoreList"
+		listKinds[schema.GroupVersionResource{Group: "external-secrets.io", Version: version, Resource: "clustersecretstores"}] = "ClusterSecretStoreList"
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		resource := action.GetResource()
+		if resource.Version == "v1" {
+			return true, nil, apierrors.NewNotFound(resource.GroupResource(), "")
+		}
+		return false, nil, nil
+	})
+	return client
+}
+
+func newUnstructuredStore(kind string, name string, namespace string, provider map[string]interface{}) *unstructured.Unstructured {
+	metadata := map[string]interface{}{"name": name}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "external-secrets.io/v1beta1",
+			"kind":       kind,
+			"metadata":   metadata,
+			"spec": map[string]interface{}{
+				"provider": provider,
+			},
+		},
+	}
+}
+
+func TestLoadStoresFromCluster(t *testing.T) {
+	ctx := context.TODO()
+	store := newUnstructuredStore("SecretStore", "team-a-aws", "team-a", map[string]interface{}{
+		"aws": map[string]interface{}{
+			"service": "SecretsManager",
+			"region":  "eu-west-1",
+		},
+	})
+	c := provider.KesToEsoClient{
+		DynamicClient: newESOStoresClient(store),
+		Options:       apis.NewOptions(),
+	}
+	stores := NewSecretStoreDB()
+	assert.NoError(t, LoadStoresFromCluster(ctx, stores, &c))
+	S := newAWSStore("eu-west-1")
+	S.Kind = "SecretStore"
+	S.ObjectMeta.Namespace = "team-a"
+	entry, created := stores.Bind(S, apis.ESOStoreExtensions{}, "team-a/kes")
+	assert.False(t, created)
+	assert.Equal(t, "team-a-aws", entry.Store.ObjectMeta.Name)
+	assert.Equal(t, "cluster", entry.Source)
+}
+
+func TestStoreFromObjectUnsupported(t *testing.T) {
+	entry, ok, err := storeFromObject(newUnstructuredStore("ClusterSecretStore", "aws", "", map[string]interface{}{
+		"aws": map[string]interface{}{
+			"service":         "SecretsManager",
+			"region":          "eu-west-1",
+			"additionalRoles": []interface{}{"arn:aws:iam::123412341234:role/chained"},
+		},
+	}).Object)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"aws.additionalRoles[0]"}, entry.Unsupported)
+	entry.Source = "cluster"
+	stores := NewSecretStoreDB()
+	stores.Add(entry)
+	S := newAWSStore("eu-west-1")
+	S.ObjectMeta.Name = "generated"
+	created, isNew := stores.Bind(S, apis.ESOStoreExtensions{}, "default/kes")
+	assert.True(t, isNew)
+	matches := nearMatches(stores, created)
+	if assert.Len(t, matches, 1) {
+		assert.Equal(t, []string{"aws.additionalRoles[0]"}, matches[0].Fields)
+	}
+}
+
+func TestNearMatches(t *testing.T) {
+	aws := func(region string, secret string) map[string]interface{} {
+		p := map[string]interface{}{
+			"service": "SecretsManager",
+			"region":  region,
+		}
+		if secret != "" {
+			p["auth"] = map[string]interface{}{
+				"secretRef": map[string]interface{}{
+					"accessKeyIDSecretRef": map[string]interface{}{"name": secret, "key": "id"},
+				},
+			}
+		}
+		return map[string]interface{}{"aws": p}
+	}
+	stores := NewSecretStoreDB()
+	for _, obj := range []*unstructured.Unstructured{
+		newUnstructuredStore("ClusterSecretStore", "other-auth", "", aws("eu-west-1", "eso-aws")),
+		newUnstructuredStore("ClusterSecretStore", "other-region", "", aws("us-east-1", "")),
+		newUnstructuredStore("SecretStore", "other-namespace", "team-b", aws("eu-west-1", "")),
+		newUnstructuredStore("ClusterSecretStore", "same-secret-other-key", "", aws("eu-west-1", "kes-aws")),
+	} {
+		entry, _, err := storeFromObject(obj.Object)
+		assert.NoError(t, err)
+		entry.Source = "cluster"
+		stores.Add(entry)
+	}
+	S := newAWSStore("eu-west-1")
+	S.Kind = "SecretStore"
+	S.ObjectMeta.Namespace = "team-a"
+	S.Spec.Provider.AWS.Auth.SecretRef = &api.AWSAuthSecretRef{}
+	S.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Name = "kes-aws"
+	S.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Key = "access-key"
+	entry, created := stores.Bind(S, apis.ESOStoreExtensions{}, "team-a/kes")
+	assert.True(t, created)
+	matches := nearMatches(stores, entry)
+	names := make([]string, 0)
+	for _, match := range matches {
+		names = append(names, match.Entry.Store.ObjectMeta.Name)
+	}
+	assert.Equal(t, []string{"other-auth", "same-secret-other-key"}, names)
+	if assert.Len(t, matches, 2) {
+		assert.Equal(t, []string{
+			"aws.auth.secretRef.accessKeyIDSecretRef.key",
+			"aws.auth.secretRef.accessKeyIDSecretRef.name",
+			"kind",
+		}, matches[0].Fields)
+		assert.Equal(t, []string{"aws.auth.secretRef.accessKeyIDSecretRef.key", "kind"}, matches[1].Fields)
+	}
+}
+
+func TestRootReusesClusterStores(t *testing.T) {
+	ctx := context.TODO()
+	store := newUnstructuredStore("ClusterSecretStore", "aws-shared", "", map[string]interface{}{
+		"aws": map[string]interface{}{
+			"service": "SecretsManager",
+			"region":  "eu-west-1",
+			"role":    "arn:aws:iam::123412341234:role/let-other-account-access-secrets",
+		},
+	})
+	store.Object["spec"].(map[string]interface{})["retrySettings"] = map[string]interface{}{"maxRetries": int64(3)}
+	output := t.TempDir()
+	options := apis.NewOptions()
+	options.InputPath = "testdata/aws-secretsmanager.golden"
+	options.OutputPath = output
+	c := provider.KesToEsoClient{
+		Client:        testclient.NewSimpleClientset(),
+		DynamicClient: newESOStoresClient(store),
+		Options:       options,
+	}
+	resp, _ := Root(ctx, &c)
+	if assert.Len(t, resp, 1) && assert.NoError(t, resp[0].Err) {
+		assert.Equal(t, "aws-shared", resp[0].Es.Spec.SecretStoreRef.Name)
+		assert.Equal(t, "ClusterSecretStore", resp[0].Es.Spec.SecretStoreRef.Kind)
+	}
+	files, err := filepath.Glob(filepath.Join(output, "secret-store-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,674 @@
+package parser
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// KES renders templates with lodash, evaluating JavaScript with the fetched
+// values available as `data`. ESO renders Go templates, so every expression
+// is parsed into a small tree and printed back with the functions of the ESO
+// template engine in use.
+
+const (
+	templateEngineV1 = "v1" // values are []byte, functions from ESO itself
+	templateEngineV2 = "v2" // values are strings, sprig functions
+)
+
+type tplNodeKind int
+
+const (
+	tplLiteral tplNodeKind = iota
+	tplData
+	tplProperty
+	tplJSONParse
+	tplJSONStringify
+	tplBase64Decode
+	tplBase64Encode
+	tplUpper
+	tplLower
+	tplTrim
+	tplYAMLDump
+	tplHTML
+	tplConcat
+)
+
+type tplNode struct {
+	kind  tplNodeKind
+	value string // literal text, data key or property name
+	args  []*tplNode
+}
+
+// tplBuffer is an intermediate value for Buffer.from(x, encoding), which only
+// makes sense once followed by .toString(encoding).
+type tplBuffer struct {
+	arg      *tplNode
+	encoding string
+}
+
+var lodashDelimiters = regexp.MustCompile(`(?s)<%([=-]?)(.*?)%>|\$\{(.*?)\}`)
+
+// translateTemplate translates a KES lodash template value into an ESO
+// template for the given engine. When encoded is set, the KES value renders to
+// base64 (as in a Secret's `data`), while ESO expects the plain value.
+func translateTemplate(value string, engine string, encoded bool) (string, error) {
+	root, err := parseLodash(value)
+	if err != nil {
+		return "", err
+	}
+	if encoded {
+		root = simplify(&tplNode{kind: tplBase64Decode, args: []*tplNode{root}})
+		if root.kind == tplBase64Decode && root.args[0].kind == tplLiteral {
+			return "", fmt.Errorf("cannot translate KES template value %q: it is not valid base64", value)
+		}
+	}
+	if root.kind == tplLiteral {
+		return escapeGoTemplate(root.value), nil
+	}
+	parts := []*tplNode{root}
+	if root.kind == tplConcat {
+		parts = root.args
+	}
+	var out strings.Builder
+	for _, part := range parts {
+		if part.kind == tplLiteral {
+			out.WriteString(escapeGoTemplate(part.value))
+			continue
+		}
+		expr, err := renderOutput(part, engine)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString("{{ " + expr + " }}")
+	}
+	return out.String(), nil
+}
+
+// base64DecodeTemplate returns an ESO template decoding the fetched value of
+// key from base64.
+func base64DecodeTemplate(key string, engine string) (string, error) {
+	node := &tplNode{kind: tplBase64Decode, args: []*tplNode{{kind: tplData, value: key}}}
+	expr, err := renderOutput(node, engine)
+	if err != nil {
+		return "", err
+	}
+	return "{{ " + expr + " }}", nil
+}
+
+func isLodashTemplate(value string) bool {
+	return lodashDelimiters.MatchString(value)
+}
+
+func escapeGoTemplate(s string) string {
+	return strings.ReplaceAll(s, "{{", `{{ "{{" }}`)
+}
+
+func parseLodash(value string) (*tplNode, error) {
+	parts := make([]*tplNode, 0)
+	last := 0
+	for _, loc := range lodashDelimiters.FindAllStringSubmatchIndex(value, -1) {
+		if loc[0] > last {
+			parts = append(parts, &tplNode{kind: tplLiteral, value: value[last:loc[0]]})
+		}
+		last = loc[1]
+		var expr string
+		escape := false
+		if loc[2] >= 0 {
+			marker := value[loc[2]:loc[3]]
+			expr = value[loc[4]:loc[5]]
+			if marker == "" {
+				return nil, fmt.Errorf("cannot translate KES template block %q: evaluate blocks have no ESO equivalent", value[loc[0]:loc[1]])
+			}
+			escape = marker == "-"
+		} else {
+			expr = value[loc[6]:loc[7]]
+		}
+		node, err := parseExpression(expr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot translate KES template expression %q: %v", strings.TrimSpace(expr), err)
+		}
+		if escape {
+			node = &tplNode{kind: tplHTML, args: []*tplNode{node}}
+		}
+		parts = append(parts, node)
+	}
+	if last < len(value) {
+		parts = append(parts, &tplNode{kind: tplLiteral, value: value[last:]})
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return simplify(&tplNode{kind: tplConcat, args: parts}), nil
+}
+
+// simplify folds nodes that cancel each other out or that can be evaluated
+// while converting.
+func simplify(n *tplNode) *tplNode {
+	for idx, arg := range n.args {
+		n.args[idx] = simplify(arg)
+	}
+	switch n.kind {
+	case tplBase64Decode:
+		arg := n.args[0]
+		if arg.kind == tplBase64Encode {
+			return arg.args[0]
+		}
+		if arg.kind == tplLiteral {
+			dat, err := base64.StdEncoding.DecodeString(arg.value)
+			if err == nil {
+				return &tplNode{kind: tplLiteral, value: string(dat)}
+			}
+		}
+	case tplBase64Encode:
+		if n.args[0].kind == tplBase64Decode {
+			return n.args[0].args[0]
+		}
+	case tplConcat:
+		merged := make([]*tplNode, 0, len(n.args))
+		for _, arg := range n.args {
+			if arg.kind == tplConcat {
+				merged = append(merged, arg.args...)
+				continue
+			}
+			if arg.kind == tplLiteral && len(merged) > 0 && merged[len(merged)-1].kind == tplLiteral {
+				merged[len(merged)-1] = &tplNode{kind: tplLiteral, value: merged[len(merged)-1].value + arg.value}
+				continue
+			}
+			merged = append(merged, arg)
+		}
+		if len(merged) == 1 {
+			return merged[0]
+		}
+		n.args = merged
+	}
+	return n
+}
+
+// Expression parsing
+
+type tplToken struct {
+	kind  string // ident, string, punct
+	value string
+}
+
+func tokenize(expr string) ([]tplToken, error) {
+	tokens := make([]tplToken, 0)
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '_' || r == '$' || unicode.IsLetter(r):
+			j := i
+			for j < len(runes) && (runes[j] == '_' || runes[j] == '$' || unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j])) {
+				j++
+			}
+			tokens = append(tokens, tplToken{kind: "ident", value: string(runes[i:j])})
+			i = j
+		case r == '\'' || r == '"' || r == '`':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				if r == '`' && runes[j] == '$' && j+1 < len(runes) && runes[j+1] == '{' {
+					return nil, fmt.Errorf("template literals with placeholders are not supported")
+				}
+				b.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, tplToken{kind: "string", value: b.String()})
+			i = j + 1
+		case strings.ContainsRune(".[](),+", r):
+			tokens = append(tokens, tplToken{kind: "punct", value: string(r)})
+			i++
+		default:
+			return nil, fmt.Errorf("unsupported character %q", r)
+		}
+	}
+	return tokens, nil
+}
+
+type tplParser struct {
+	tokens []tplToken
+	pos    int
+}
+
+func parseExpression(expr string) (*tplNode, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	p := &tplParser{tokens: tokens}
+	node, err := p.parseConcat()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].value)
+	}
+	return simplify(node), nil
+}
+
+func (p *tplParser) peek(value string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind != "string" && p.tokens[p.pos].value == value
+}
+
+func (p *tplParser) expect(value string) error {
+	if !p.peek(value) {
+		if p.pos < len(p.tokens) {
+			return fmt.Errorf("expected %q, got %q", value, p.tokens[p.pos].value)
+		}
+		return fmt.Errorf("expected %q", value)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *tplParser) next(kind string) (string, error) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != kind {
+		return "", fmt.Errorf("expected %v", kind)
+	}
+	p.pos++
+	return p.tokens[p.pos-1].value, nil
+}
+
+func (p *tplParser) parseConcat() (*tplNode, error) {
+	node, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if !p.peek("+") {
+		return node, nil
+	}
+	parts := []*tplNode{node}
+	for p.peek("+") {
+		p.pos++
+		node, err = p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, node)
+	}
+	return &tplNode{kind: tplConcat, args: parts}, nil
+}
+
+func (p *tplParser) parseValue() (*tplNode, error) {
+	primary, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	var node *tplNode
+	var buffer *tplBuffer
+	switch v := primary.(type) {
+	case *tplNode:
+		node = v
+	case *tplBuffer:
+		buffer = v
+	}
+	for {
+		switch {
+		case p.peek("."):
+			p.pos++
+			name, err := p.next("ident")
+			if err != nil {
+				return nil, err
+			}
+			if p.peek("(") {
+				args, err := p.parseStringArgs()
+				if err != nil {
+					return nil, err
+				}
+				if buffer != nil {
+					if name != "toString" {
+						return nil, fmt.Errorf("Buffer.%v() is not supported", name)
+					}
+					node, err = bufferToString(buffer, args)
+					if err != nil {
+						return nil, err
+					}
+					buffer = nil
+					continue
+				}
+				node, err = applyMethod(node, name, args)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if buffer != nil {
+				return nil, fmt.Errorf("Buffer.%v is not supported", name)
+			}
+			node, err = property(node, name)
+			if err != nil {
+				return nil, err
+			}
+		case p.peek("["):
+			p.pos++
+			name, err := p.next("string")
+			if err != nil {
+				return nil, fmt.Errorf("only string literals are supported as property names")
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if buffer != nil {
+				return nil, fmt.Errorf("indexing a Buffer is not supported")
+			}
+			node, err = property(node, name)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if buffer != nil {
+				// a Buffer used as a string is implicitly decoded as utf8
+				return bufferToString(buffer, nil)
+			}
+			if node.kind == tplData && node.value == "" {
+				return nil, fmt.Errorf("`data` must be used with a key")
+			}
+			return node, nil
+		}
+	}
+}
+
+func (p *tplParser) parseStringArgs() ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := make([]string, 0)
+	for !p.peek(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.next("string")
+		if err != nil {
+			return nil, fmt.Errorf("only string literals are supported as method arguments")
+		}
+		args = append(args, arg)
+	}
+	p.pos++
+	return args, nil
+}
+
+func (p *tplParser) parseCall() (*tplNode, string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, "", err
+	}
+	arg, err := p.parseConcat()
+	if err != nil {
+		return nil, "", err
+	}
+	extra := ""
+	if p.peek(",") {
+		p.pos++
+		extra, err = p.next("string")
+		if err != nil {
+			return nil, "", fmt.Errorf("only string literals are supported as extra arguments")
+		}
+	}
+	return arg, extra, p.expect(")")
+}
+
+func (p *tplParser) parsePrimary() (interface{}, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	if tok.kind == "string" {
+		return &tplNode{kind: tplLiteral, value: tok.value}, nil
+	}
+	if tok.value == "(" {
+		node, err := p.parseConcat()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	}
+	if tok.kind != "ident" {
+		return nil, fmt.Errorf("unexpected %q", tok.value)
+	}
+	switch tok.value {
+	case "data":
+		return &tplNode{kind: tplData}, nil
+	case "String":
+		arg, _, err := p.parseCall()
+		return arg, err
+	case "JSON", "Buffer", "yaml":
+		if err := p.expect("."); err != nil {
+			return nil, err
+		}
+		fn, err := p.next("ident")
+		if err != nil {
+			return nil, err
+		}
+		name := tok.value + "." + fn
+		arg, extra, err := p.parseCall()
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "JSON.parse":
+			return &tplNode{kind: tplJSONParse, args: []*tplNode{arg}}, nil
+		case "JSON.stringify":
+			if extra != "" {
+				return nil, fmt.Errorf("JSON.stringify options are not supported")
+			}
+			return &tplNode{kind: tplJSONStringify, args: []*tplNode{arg}}, nil
+		case "Buffer.from":
+			return &tplBuffer{arg: arg, encoding: extra}, nil
+		case "yaml.dump", "yaml.safeDump":
+			return &tplNode{kind: tplYAMLDump, args: []*tplNode{arg}}, nil
+		}
+		return nil, fmt.Errorf("%v is not supported", name)
+	}
+	return nil, fmt.Errorf("%v is not supported", tok.value)
+}
+
+func property(node *tplNode, name string) (*tplNode, error) {
+	if node.kind == tplData {
+		if node.value != "" {
+			return nil, fmt.Errorf("data.%v.%v: fetched values are strings, use JSON.parse to read properties", node.value, name)
+		}
+		return &tplNode{kind: tplData, value: name}, nil
+	}
+	if node.kind == tplJSONParse || node.kind == tplProperty {
+		return &tplNode{kind: tplProperty, value: name, args: []*tplNode{node}}, nil
+	}
+	return nil, fmt.Errorf("property %v is not supported here", name)
+}
+
+func applyMethod(node *tplNode, name string, args []string) (*tplNode, error) {
+	switch name {
+	case "toString":
+		return node, nil
+	case "toUpperCase":
+		return &tplNode{kind: tplUpper, args: []*tplNode{node}}, nil
+	case "toLowerCase":
+		return &tplNode{kind: tplLower, args: []*tplNode{node}}, nil
+	case "trim":
+		return &tplNode{kind: tplTrim, args: []*tplNode{node}}, nil
+	}
+	return nil, fmt.Errorf("method %v() is not supported", name)
+}
+
+func normalizeEncoding(encoding string) string {
+	switch strings.ToLower(encoding) {
+	case "", "utf8", "utf-8", "ascii", "latin1", "binary":
+		return "utf8"
+	}
+	return strings.ToLower(encoding)
+}
+
+func bufferToString(buffer *tplBuffer, args []string) (*tplNode, error) {
+	from := normalizeEncoding(buffer.encoding)
+	to := "utf8"
+	if len(args) > 0 {
+		to = normalizeEncoding(args[0])
+	}
+	switch {
+	case from == to:
+		return buffer.arg, nil
+	case from == "utf8" && to == "base64":
+		return &tplNode{kind: tplBase64Encode, args: []*tplNode{buffer.arg}}, nil
+	case from == "base64" && to == "utf8":
+		return &tplNode{kind: tplBase64Decode, args: []*tplNode{buffer.arg}}, nil
+	}
+	return nil, fmt.Errorf("converting a Buffer from %v to %v is not supported", from, to)
+}
+
+// Rendering
+
+type tplValueKind int
+
+const (
+	tplBytes  tplValueKind = iota // only with engine v1
+	tplString                     // a string value
+	tplAny                        // anything read out of JSON
+)
+
+var goIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func renderOutput(n *tplNode, engine string) (string, error) {
+	expr, kind, err := render(n, engine)
+	if err != nil {
+		return "", err
+	}
+	if kind == tplBytes {
+		return expr + " | toString", nil
+	}
+	return expr, nil
+}
+
+func renderString(n *tplNode, engine string) (string, error) {
+	expr, kind, err := render(n, engine)
+	if err != nil {
+		return "", err
+	}
+	if kind == tplBytes {
+		return "(" + expr + " | toString)", nil
+	}
+	return expr, nil
+}
+
+func renderBytes(n *tplNode, engine string) (string, error) {
+	expr, kind, err := render(n, engine)
+	if err != nil {
+		return "", err
+	}
+	if kind != tplBytes {
+		return "(" + expr + " | toBytes)", nil
+	}
+	return expr, nil
+}
+
+// renderInput renders the argument of a function taking the engine's
+// native value type: []byte for v1 and string for v2.
+func renderInput(n *tplNode, engine string) (string, error) {
+	if engine == templateEngineV1 {
+		return renderBytes(n, engine)
+	}
+	return renderString(n, engine)
+}
+
+func render(n *tplNode, engine string) (string, tplValueKind, error) {
+	native := tplString
+	if engine == templateEngineV1 {
+		native = tplBytes
+	}
+	switch n.kind {
+	case tplLiteral:
+		return strconv.Quote(n.value), tplString, nil
+	case tplData:
+		if goIdentifier.MatchString(n.value) {
+			return "." + n.value, native, nil
+		}
+		return fmt.Sprintf("(index . %v)", strconv.Quote(n.value)), native, nil
+	case tplProperty:
+		obj, _, err := render(n.args[0], engine)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("(index %v %v)", obj, strconv.Quote(n.value)), tplAny, nil
+	case tplJSONParse:
+		fn := "fromJSON"
+		if engine == templateEngineV2 {
+			fn = "fromJson"
+		}
+		arg, err := renderInput(n.args[0], engine)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("(%v | %v)", arg, fn), tplAny, nil
+	case tplJSONStringify:
+		fn := "toJSON"
+		if engine == templateEngineV2 {
+			fn = "toJson"
+		}
+		arg, err := renderString(n.args[0], engine)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("(%v | %v)", arg, fn), tplString, nil
+	case tplBase64Decode, tplBase64Encode:
+		fn := map[tplNodeKind]string{tplBase64Decode: "base64decode", tplBase64Encode: "base64encode"}[n.kind]
+		if engine == templateEngineV2 {
+			fn = map[tplNodeKind]string{tplBase64Decode: "b64dec", tplBase64Encode: "b64enc"}[n.kind]
+		}
+		arg, err := renderInput(n.args[0], engine)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("(%v | %v)", arg, fn), native, nil
+	case tplUpper, tplLower, tplTrim:
+		fn := map[tplNodeKind]string{tplUpper: "upper", tplLower: "lower", tplTrim: "trim"}[n.kind]
+		if engine == templateEngineV1 && n.kind == tplTrim {
+			return "", 0, fmt.Errorf("trim() needs ESO template engine v2")
+		}
+		arg, err := renderString(n.args[0], engine)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("(%v | %v)", arg, fn), tplString, nil
+	case tplYAMLDump:
+		if engine == templateEngineV1 {
+			return "", 0, fmt.Errorf("yaml.dump() needs ESO template engine v2")
+		}
+		arg, _, err := render(n.args[0], engine)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("(%v | toYaml)", arg), tplString, nil
+	case tplHTML:
+		arg, err := renderString(n.args[0], engine)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("(%v | html)", arg), tplString, nil
+	case tplConcat:
+		args := make([]string, 0, len(n.args))
+		for _, arg := range n.args {
+			rendered, err := renderString(arg, engine)
+			if err != nil {
+				return "", 0, err
+			}
+			args = append(args, rendered)
+		}
+		return fmt.Sprintf("(printf %v %v)", strconv.Quote(strings.Repeat("%v", len(args))), strings.Join(args, " ")), tplString, nil
+	}
+	return "", 0, fmt.Errorf("unknown template node")
+}
@@ -0,0 +1,164 @@
+package parser
+
+import (
+	"testing"
+
+	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateTemplate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		value   string
+		encoded bool
+		v1      string
+		v2      string
+	}{
+		{
+			name:  "literal",
+			value: "plain {{ text }}",
+			v1:    `plain {{ "{{" }} text }}`,
+			v2:    `plain {{ "{{" }} text }}`,
+		},
+		{
+			name:  "data reference",
+			value: "user=<%= data.username %>, pass=<%= data['db-password'] %>",
+			v1:    `user={{ .username | toString }}, pass={{ (index . "db-password") | toString }}`,
+			v2:    `user={{ .username }}, pass={{ (index . "db-password") }}`,
+		},
+		{
+			name:  "es interpolation",
+			value: "${data.username}",
+			v1:    `{{ .username | toString }}`,
+			v2:    `{{ .username }}`,
+		},
+		{
+			name:  "json property",
+			value: "<%= JSON.parse(data.config).database.host %>",
+			v1:    `{{ (index (index (.config | fromJSON) "database") "host") }}`,
+			v2:    `{{ (index (index (.config | fromJson) "database") "host") }}`,
+		},
+		{
+			name:  "json stringify",
+			value: "<%= JSON.stringify(JSON.parse(data.config).database) %>",
+			v1:    `{{ ((index (.config | fromJSON) "database") | toJSON) }}`,
+			v2:    `{{ ((index (.config | fromJson) "database") | toJson) }}`,
+		},
+		{
+			name:  "base64 decode",
+			value: "<%= Buffer.from(data.cert, 'base64').toString('utf8') %>",
+			v1:    `{{ (.cert | base64decode) | toString }}`,
+			v2:    `{{ (.cert | b64dec) }}`,
+		},
+		{
+			name:    "base64 encoded data is decoded by ESO",
+			value:   "<%= Buffer.from(data.password).toString('base64') %>",
+			encoded: true,
+			v1:      `{{ .password | toString }}`,
+			v2:      `{{ .password }}`,
+		},
+		{
+			name:    "base64 literal data",
+			value:   "aGVsbG8=",
+			encoded: true,
+			v1:      `hello`,
+			v2:      `hello`,
+		},
+		{
+			name:    "base64 expression data",
+			value:   "<%= data.keystore %>",
+			encoded: true,
+			v1:      `{{ (.keystore | base64decode) | toString }}`,
+			v2:      `{{ (.keystore | b64dec) }}`,
+		},
+		{
+			name:  "concatenation and methods",
+			value: "<%= data.user.toUpperCase() + ':' + String(data.pass) %>",
+			v1:    `{{ ((.user | toString) | upper) }}:{{ .pass | toString }}`,
+			v2:    `{{ (.user | upper) }}:{{ .pass }}`,
+		},
+		{
+			name:  "nested concatenation",
+			value: "Basic <%= Buffer.from(data.user + ':' + data.pass).toString('base64') %>",
+			v1:    `Basic {{ (((printf "%v%v%v" (.user | toString) ":" (.pass | toString)) | toBytes) | base64encode) | toString }}`,
+			v2:    `Basic {{ ((printf "%v%v%v" .user ":" .pass) | b64enc) }}`,
+		},
+		{
+			name:  "escaped interpolation",
+			value: "<%- data.name %>",
+			v1:    `{{ ((.name | toString) | html) }}`,
+			v2:    `{{ (.name | html) }}`,
+		},
+	}
+	for _, tc := range testCases {
+		got, err := translateTemplate(tc.value, templateEngineV1, tc.encoded)
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.v1, got, tc.name)
+		}
+		got, err = translateTemplate(tc.value, templateEngineV2, tc.encoded)
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, tc.v2, got, tc.name)
+		}
+	}
+}
+
+func TestTranslateTemplateErrors(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  string
+	}{
+		{"<% if (data.a) { %>a<% } %>", `cannot translate KES template block "<% if (data.a) { %>": evaluate blocks have no ESO equivalent`},
+		{"<%= data.items.length %>", `cannot translate KES template expression "data.items.length": data.items.length: fetched values are strings, use JSON.parse to read properties`},
+		{"<%= data.items.map(x => x) %>", `cannot translate KES template expression "data.items.map(x => x)": unsupported character '='`},
+		{"<%= _.upperCase(data.a) %>", `cannot translate KES template expression "_.upperCase(data.a)": _ is not supported`},
+		{"<%= data %>", "cannot translate KES template expression \"data\": `data` must be used with a key"},
+		{"<%= Buffer.from(data.a, 'hex').toString() %>", `cannot translate KES template expression "Buffer.from(data.a, 'hex').toString()": converting a Buffer from hex to utf8 is not supported`},
+	}
+	for _, tc := range testCases {
+		_, err := translateTemplate(tc.value, templateEngineV2, false)
+		if assert.Error(t, err, tc.value) {
+			assert.Equal(t, tc.want, err.Error())
+		}
+	}
+	_, err := translateTemplate("<%= yaml.dump(JSON.parse(data.a)) %>", templateEngineV1, false)
+	assert.EqualError(t, err, "yaml.dump() needs ESO template engine v2")
+	_, err = translateTemplate("not base64!", templateEngineV1, true)
+	assert.EqualError(t, err, `cannot translate KES template value "not base64!": it is not valid base64`)
+}
+
+func TestFillTemplate(t *testing.T) {
+	m := map[string]interface{}{
+		"type": "kubernetes.io/tls",
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{
+				"app":     "demo",
+				"version": "<%= data.version %>",
+			},
+		},
+		"data": map[string]interface{}{
+			"tls.crt": "<%= data.crt %>",
+			"literal": "aGVsbG8=",
+			"broken":  "<% for (const x of data) { %>",
+		},
+		"stringData": map[string]interface{}{
+			"config.yaml": "host: <%= JSON.parse(data.db).host %>\n",
+			"literal":     "overrides data",
+		},
+		"immutable": true,
+	}
+	got, err := fillTemplate(nil, m, templateEngineV1, nil)
+	assert.NoError(t, err)
+	want := api.ExternalSecretTemplate{
+		Type: "kubernetes.io/tls",
+		Metadata: api.ExternalSecretTemplateMetadata{
+			Labels: map[string]string{"app": "demo"},
+		},
+		Data: map[string]string{
+			"tls.crt":     `{{ (.crt | base64decode) | toString }}`,
+			"literal":     "overrides data",
+			"config.yaml": "host: {{ (index (.db | fromJSON) \"host\") }}\n",
+		},
+	}
+	assert.Equal(t, want, got)
+}
@@ -0,0 +1,286 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kestoeso/pkg/apis"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var KESExternalSecretResource = schema.GroupVersionResource{
+	Group:    "kubernetes-client.io",
+	Version:  "v1",
+	Resource: "externalsecrets",
+}
+
+var ESOStoreResources = []string{"secretstores", "clustersecretstores"}
+
+// ESOStoreVersions are the ESO API versions stores are read with, newest
+// first, so that no field is lost to a conversion.
+var ESOStoreVersions = []string{"v1", "v1beta1", "v1alpha1"}
+
+// ListESOStores reads every ESO SecretStore and ClusterSecretStore of the
+// cluster.
+func (c KesToEsoClient) ListESOStores(ctx context.Context) ([]map[string]interface{}, error) {
+	if c.DynamicClient == nil {
+		return nil, errors.New("no dynamic client available to read ESO stores from the cluster")
+	}
+	ans := make([]map[string]interface{}, 0)
+	for _, resource := range ESOStoreResources {
+		for _, version := range ESOStoreVersions {
+			gvr := schema.GroupVersionResource{Group: "external-secrets.io", Version: version, Resource: resource}
+			list, err := c.DynamicClient.Resource(gvr).List(ctx, metav1.ListOptions{})
+			if apierrors.IsNotFound(err) {
+				// version not served, or ESO is not installed
+				continue
+			}
+			if err != nil {
+				return ans, err
+			}
+			for _, item := range list.Items {
+				ans = append(ans, item.Object)
+			}
+			break
+		}
+	}
+	return ans, nil
+}
+
+// ListKESExternalSecrets reads KES ExternalSecrets straight from the cluster,
+// filtered by Options.SourceNamespace (all namespaces when empty) and
+// Options.LabelSelector.
+func (c KesToEsoClient) ListKESExternalSecrets(ctx context.Context) ([]apis.KESExternalSecret, error) {
+	if c.DynamicClient == nil {
+		return nil, errors.New("no dynamic client available to read KES ExternalSecrets from the cluster")
+	}
+	list, err := c.DynamicClient.Resource(KESExternalSecretResource).Namespace(c.Options.SourceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: c.Options.LabelSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ans := make([]apis.KESExternalSecret, 0, len(list.Items))
+	for _, item := range list.Items {
+		dat, err := json.Marshal(item.Object)
+		if err != nil {
+			return ans, err
+		}
+		K := apis.KESExternalSecret{}
+		err = json.Unmarshal(dat, &K)
+		if err != nil {
+			return ans, err
+		}
+		ans = append(ans, K)
+	}
+	return ans, nil
+}
+
+// DiscoverKESInstances finds every KES instance among the workloads of
+// FindKESWorkloads. It returns the workload of each instance keyed by its
+// INSTANCE_ID, which is empty for the instance handling ExternalSecrets
+// without a controllerId.
+func (c KesToEsoClient) DiscoverKESInstances(ctx context.Context) (map[string]KESWorkload, error) {
+	workloads, err := c.FindKESWorkloads(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ans := make(map[string]KESWorkload)
+	for _, w := range workloads {
+		profile, err := c.forWorkload(w).KESProfile(ctx)
+		if err != nil {
+			return ans, fmt.Errorf("could not read %v: %w", w, err)
+		}
+		// An INSTANCE_ID that can't be read would route ExternalSecrets
+		// to the wrong instance.
+		id, err := profile.Value("INSTANCE_ID")
+		if err != nil {
+			return ans, fmt.Errorf("could not read the INSTANCE_ID of %v: %w", w, err)
+		}
+		if other, ok := ans[id]; ok {
+			return ans, fmt.Errorf("KES workloads %v and %v both use INSTANCE_ID %q", other, w, id)
+		}
+		ans[id] = w
+	}
+	return ans, nil
+}
+
+// ForInstance returns a client reading credentials from the KES workload
+// of the given instance. The client itself is returned for the default
+// instance or when the instance is unknown.
+func (c *KesToEsoClient) ForInstance(id string) *KesToEsoClient {
+	w, ok := c.Instances[id]
+	if id == "" || !ok {
+		return c
+	}
+	return c.forWorkload(w)
+}
+
+// forWorkload returns a copy of the client reading credentials from w.
+func (c KesToEsoClient) forWorkload(w KESWorkload) *KesToEsoClient {
+	opt := *c.Options
+	c.Options = &opt
+	c.UseKESWorkload(w)
+	return &c
+}
+
+// KESWorkload is a Deployment or StatefulSet running KES.
+type KESWorkload struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Container string
+}
+
+func (w KESWorkload) String() string {
+	return fmt.Sprintf("%v %v/%v (container %v)", w.Kind, w.Namespace, w.Name, w.Container)
+}
+
+// kesImageName is the name of the KES image, whatever its registry and tag.
+const kesImageName = "kubernetes-external-secrets"
+
+// isKESImage tells whether image is a KES image, such as
+// ghcr.io/external-secrets/kubernetes-external-secrets:8.5.5.
+func isKESImage(image string) bool {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return name == kesImageName
+}
+
+// hasKESChartLabels tells whether labels are the ones the
+// kubernetes-external-secrets chart sets.
+func hasKESChartLabels(labels map[string]string) bool {
+	return labels["app.kubernetes.io/name"] == kesImageName || strings.HasPrefix(labels["helm.sh/chart"], kesImageName+"-")
+}
+
+// kesContainer returns the KES container of a workload: the one running the
+// KES image or, for workloads with the chart labels, the one named
+// containerName or the only one.
+func kesContainer(meta metav1.ObjectMeta, template corev1.PodTemplateSpec, containerName string) (string, bool) {
+	containers := template.Spec.Containers
+	for _, container := range containers {
+		if isKESImage(container.Image) {
+			return container.Name, true
+		}
+	}
+	if !hasKESChartLabels(meta.Labels) && !hasKESChartLabels(template.ObjectMeta.Labels) {
+		return "", false
+	}
+	if name, ok := namedContainer(template, containerName); ok {
+		return name, true
+	}
+	if len(containers) == 1 {
+		return containers[0].Name, true
+	}
+	return "", false
+}
+
+// namedContainer returns the container called name, if the pod has one.
+func namedContainer(template corev1.PodTemplateSpec, name string) (string, bool) {
+	for _, container := range template.Spec.Containers {
+		if container.Name == name {
+			return container.Name, true
+		}
+	}
+	return "", false
+}
+
+// FindKESWorkloads lists the Deployments and StatefulSets of every namespace,
+// or of the KES manifests when given, that run the KES image or carry the
+// labels of the kubernetes-external-secrets chart, along with those of
+// Options.Namespace running a container named Options.ContainerName.
+func (c KesToEsoClient) FindKESWorkloads(ctx context.Context) ([]KESWorkload, error) {
+	var workloads []workload
+	if c.KES != nil {
+		workloads = c.KES.workloads()
+	} else {
+		deployments, err := c.Client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, deployment := range deployments.Items {
+			workloads = append(workloads, workload{"Deployment", deployment.ObjectMeta, deployment.Spec.Template})
+		}
+		statefulSets, err := c.Client.AppsV1().StatefulSets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, statefulSet := range statefulSets.Items {
+			workloads = append(workloads, workload{"StatefulSet", statefulSet.ObjectMeta, statefulSet.Spec.Template})
+		}
+	}
+	ans := make([]KESWorkload, 0)
+	for _, w := range workloads {
+		container, ok := kesContainer(w.meta, w.template, c.Options.ContainerName)
+		if !ok && w.meta.Namespace == c.Options.Namespace {
+			container, ok = namedContainer(w.template, c.Options.ContainerName)
+		}
+		if !ok {
+			continue
+		}
+		ans = append(ans, KESWorkload{Kind: w.kind, Namespace: w.meta.Namespace, Name: w.meta.Name, Container: container})
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].String() < ans[j].String()
+	})
+	return ans, nil
+}
+
+// DetectKESWorkload looks for KES when Options doesn't name a workload
+// running a container called Options.ContainerName. It returns nil when the
+// configured workload is found, and the single candidate otherwise, those in
+// Options.Namespace first. Several candidates are listed in the error.
+func (c KesToEsoClient) DetectKESWorkload(ctx context.Context) (*KESWorkload, error) {
+	_, template, err := c.GetKESWorkload(ctx)
+	if err == nil {
+		if _, ok := namedContainer(template, c.Options.ContainerName); ok {
+			return nil, nil
+		}
+	} else if !apierrors.IsNotFound(err) && c.KES == nil {
+		return nil, err
+	}
+	candidates, err := c.FindKESWorkloads(ctx)
+	if err != nil {
+		return nil, err
+	}
+	local := make([]KESWorkload, 0)
+	for _, w := range candidates {
+		if w.Namespace == c.Options.Namespace {
+			local = append(local, w)
+		}
+	}
+	if len(local) > 0 {
+		candidates = local
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, errors.New("no Deployment or StatefulSet runs the KES image or has the kubernetes-external-secrets chart labels")
+	case 1:
+		return &candidates[0], nil
+	}
+	names := make([]string, 0, len(candidates))
+	for _, w := range candidates {
+		names = append(names, w.String())
+	}
+	return nil, fmt.Errorf("several KES workloads found, pick one with --kes-namespace, --kes-deployment-name and --kes-container-name: %v", strings.Join(names, ", "))
+}
+
+// UseKESWorkload makes the client read credentials from w.
+func (c *KesToEsoClient) UseKESWorkload(w KESWorkload) {
+	c.Options.WorkloadKind = w.Kind
+	c.Options.Namespace = w.Namespace
+	c.Options.DeploymentName = w.Name
+	c.Options.ContainerName = w.Container
+}
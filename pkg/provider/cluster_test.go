@@ -0,0 +1,243 @@
+package provider
+
+import (
+	"context"
+	"kestoeso/pkg/apis"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func newKESObject(name string, namespace string, labels map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "kubernetes-client.io/v1",
+			"kind":       "ExternalSecret",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+				"labels":    labels,
+			},
+			"spec": map[string]interface{}{
+				"backendType": "secretsManager",
+				"region":      "eu-west-1",
+				"data": []interface{}{
+					map[string]interface{}{
+						"key":      "demo-service/credentials",
+						"name":     "password",
+						"property": "password",
+					},
+				},
+			},
+		},
+	}
+}
+
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{
+		KESExternalSecretResource: "ExternalSecretList",
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+}
+
+func TestListKESExternalSecrets(t *testing.T) {
+	ctx := context.TODO()
+	faker := newFakeDynamicClient(
+		newKESObject("first", "one", map[string]interface{}{"team": "payments"}),
+		newKESObject("second", "two", map[string]interface{}{"team": "payments"}),
+		newKESObject("third", "two", map[string]interface{}{"team": "search"}),
+	)
+	opt := apis.NewOptions()
+	c := KesToEsoClient{
+		DynamicClient: faker,
+		Options:       opt,
+	}
+	kes, err := c.ListKESExternalSecrets(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, kes, 3)
+
+	opt.SourceNamespace = "two"
+	kes, err = c.ListKESExternalSecrets(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, kes, 2)
+
+	opt.LabelSelector = "team=payments"
+	kes, err = c.ListKESExternalSecrets(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, kes, 1) {
+		K := kes[0]
+		assert.Equal(t, "second", K.ObjectMeta.Name)
+		assert.Equal(t, "two", K.ObjectMeta.Namespace)
+		assert.Equal(t, "ExternalSecret", K.Kind)
+		assert.Equal(t, "kubernetes-client.io/v1", K.ApiVersion)
+		assert.Equal(t, "secretsManager", K.Spec.BackendType)
+		assert.Equal(t, "eu-west-1", K.Spec.Region)
+		assert.Equal(t, []apis.KESExternalSecretData{
+			{Key: "demo-service/credentials", Name: "password", Property: "password"},
+		}, K.Spec.Data)
+	}
+}
+
+func TestListKESExternalSecretsWithoutClient(t *testing.T) {
+	c := KesToEsoClient{Options: apis.NewOptions()}
+	_, err := c.ListKESExternalSecrets(context.TODO())
+	assert.Error(t, err)
+}
+
+func newKESDeployment(name string, container string, instanceID string) *appsv1.Deployment {
+	env := []corev1.EnvVar{}
+	if instanceID != "" {
+		env = append(env, corev1.EnvVar{Name: "INSTANCE_ID", Value: instanceID})
+	}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "kes-ns",
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: container, Env: env}},
+				},
+			},
+		},
+	}
+}
+
+func TestDiscoverKESInstances(t *testing.T) {
+	ctx := context.TODO()
+	// an instance in another namespace, reading its INSTANCE_ID from a
+	// ConfigMap
+	payments := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "kes-payments", Namespace: "payments"},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "controller",
+			Image: "ghcr.io/external-secrets/kubernetes-external-secrets:8.5.5",
+			Env: []corev1.EnvVar{{Name: "INSTANCE_ID", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "kes-config"},
+				Key:                  "instance",
+			}}}},
+		}}}}},
+	}
+	config := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "kes-config", Namespace: "payments"},
+		Data:       map[string]string{"instance": "payments"},
+	}
+	faker := testclient.NewSimpleClientset(
+		newKESDeployment("kes", "kubernetes-external-secrets", ""),
+		newKESDeployment("kes-team-a", "kubernetes-external-secrets", "team-a"),
+		newKESDeployment("unrelated", "app", "team-b"),
+		payments,
+		config,
+	)
+	opt := apis.NewOptions()
+	opt.Namespace = "kes-ns"
+	c := KesToEsoClient{
+		Client:  faker,
+		Options: opt,
+	}
+	instances, err := c.DiscoverKESInstances(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]KESWorkload{
+		"":         {Kind: "Deployment", Namespace: "kes-ns", Name: "kes", Container: "kubernetes-external-secrets"},
+		"team-a":   {Kind: "Deployment", Namespace: "kes-ns", Name: "kes-team-a", Container: "kubernetes-external-secrets"},
+		"payments": {Kind: "StatefulSet", Namespace: "payments", Name: "kes-payments", Container: "controller"},
+	}, instances)
+
+	c.Instances = instances
+	assert.Equal(t, "kes-team-a", c.ForInstance("team-a").Options.DeploymentName)
+	instance := c.ForInstance("payments").Options
+	assert.Equal(t, "StatefulSet", instance.WorkloadKind)
+	assert.Equal(t, "payments", instance.Namespace)
+	assert.Equal(t, "kes-payments", instance.DeploymentName)
+	assert.Equal(t, "controller", instance.ContainerName)
+	assert.Equal(t, "kubernetes-external-secrets", c.Options.DeploymentName)
+	assert.Equal(t, "kes-ns", c.Options.Namespace)
+	assert.Same(t, &c, c.ForInstance("team-b"))
+	assert.Same(t, &c, c.ForInstance(""))
+
+	// An INSTANCE_ID that can't be read is not mistaken for the default
+	// instance.
+	assert.NoError(t, c.Client.CoreV1().ConfigMaps("payments").Delete(ctx, "kes-config", metav1.DeleteOptions{}))
+	_, err = c.DiscoverKESInstances(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "INSTANCE_ID of StatefulSet payments/kes-payments")
+	}
+	assert.NoError(t, c.Client.AppsV1().StatefulSets("payments").Delete(ctx, "kes-payments", metav1.DeleteOptions{}))
+
+	_, err = c.Client.AppsV1().Deployments("kes-ns").Create(ctx, newKESDeployment("kes-team-a-copy", "kubernetes-external-secrets", "team-a"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = c.DiscoverKESInstances(ctx)
+	assert.Error(t, err)
+}
+
+func TestIsKESImage(t *testing.T) {
+	assert.True(t, isKESImage("ghcr.io/external-secrets/kubernetes-external-secrets:8.5.5"))
+	assert.True(t, isKESImage("registry.local:5000/kubernetes-external-secrets@sha256:abc"))
+	assert.True(t, isKESImage("kubernetes-external-secrets"))
+	assert.False(t, isKESImage("ghcr.io/external-secrets/external-secrets:v0.9.0"))
+	assert.False(t, isKESImage("kubernetes-external-secrets/sidecar:1.0"))
+}
+
+func TestDetectKESWorkload(t *testing.T) {
+	ctx := context.TODO()
+	release := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "myrelease-kubernetes-external-secrets", Namespace: "kes"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "proxy", Image: "envoyproxy/envoy:v1.20"},
+			{Name: "kes", Image: "ghcr.io/external-secrets/kubernetes-external-secrets:8.5.5"},
+		}}}},
+	}
+	labeled := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "secrets", Namespace: "tools", Labels: map[string]string{"helm.sh/chart": "kubernetes-external-secrets-8.5.5"}},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "controller", Image: "mirror.local/kes:8.5.5"},
+		}}}},
+	}
+	unrelated := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "kes"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "app:1.0"},
+		}}}},
+	}
+
+	opt := apis.NewOptions()
+	c := KesToEsoClient{Client: testclient.NewSimpleClientset(release, unrelated), Options: opt}
+	w, err := c.DetectKESWorkload(ctx)
+	if assert.NoError(t, err) && assert.NotNil(t, w) {
+		assert.Equal(t, KESWorkload{Kind: "Deployment", Namespace: "kes", Name: "myrelease-kubernetes-external-secrets", Container: "kes"}, *w)
+	}
+	c.UseKESWorkload(*w)
+	w, err = c.DetectKESWorkload(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, w, "the configured deployment is kept")
+
+	c = KesToEsoClient{Client: testclient.NewSimpleClientset(release, labeled, unrelated), Options: apis.NewOptions()}
+	_, err = c.DetectKESWorkload(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Deployment kes/myrelease-kubernetes-external-secrets (container kes)")
+		assert.Contains(t, err.Error(), "StatefulSet tools/secrets (container controller)")
+	}
+	c.Options.Namespace = "tools"
+	w, err = c.DetectKESWorkload(ctx)
+	if assert.NoError(t, err) && assert.NotNil(t, w) {
+		assert.Equal(t, KESWorkload{Kind: "StatefulSet", Namespace: "tools", Name: "secrets", Container: "controller"}, *w)
+	}
+	c.UseKESWorkload(*w)
+	meta, template, err := c.GetKESWorkload(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "secrets", meta.Name)
+	assert.Equal(t, "controller", template.Spec.Containers[0].Name)
+
+	c = KesToEsoClient{Client: testclient.NewSimpleClientset(unrelated), Options: apis.NewOptions()}
+	_, err = c.DetectKESWorkload(ctx)
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// EnvValue is the value of an env var of the KES container: a literal, or a
+// key of a Secret. Value is also set for Secret keys when the Secret could
+// be read.
+type EnvValue struct {
+	Value  string
+	Secret *corev1.SecretKeySelector // the Secret key the value comes from
+	Error  string                    // why the value could not be read
+}
+
+// resolveEnv computes the environment of container the way the kubelet does:
+// envFrom sources in order, each overriding the ones before, then env
+// entries in order, with $(VAR) references expanded against the variables
+// defined before them. It also returns why envFrom sources that are not
+// optional could not be read; the kubelet would not start such a pod.
+func (c KesToEsoClient) resolveEnv(ctx context.Context, namespace string, pod corev1.PodTemplateSpec, container corev1.Container) (map[string]EnvValue, []string) {
+	ans := make(map[string]EnvValue)
+	problems := make([]string, 0)
+	sources := newEnvSources(c, ctx, namespace)
+	for _, from := range container.EnvFrom {
+		switch {
+		case from.ConfigMapRef != nil:
+			// A missing source leaves its variables unset, and credential
+			// discovery reports them as missing.
+			cm, err := sources.configMap(from.ConfigMapRef.Name)
+			if err != nil {
+				if !optionalMissing(from.ConfigMapRef.Optional, err) {
+					problems = append(problems, fmt.Sprintf("envFrom ConfigMap %v could not be read, its variables are left unset: %v", from.ConfigMapRef.Name, err))
+				}
+				continue
+			}
+			for key, value := range cm.Data {
+				if name := from.Prefix + key; isEnvVarName(name) {
+					ans[name] = EnvValue{Value: value}
+				}
+			}
+		case from.SecretRef != nil:
+			secret, err := sources.secret(from.SecretRef.Name)
+			if err != nil {
+				if !optionalMissing(from.SecretRef.Optional, err) {
+					problems = append(problems, fmt.Sprintf("envFrom Secret %v could not be read, its variables are left unset: %v", from.SecretRef.Name, err))
+				}
+				continue
+			}
+			for key, value := range secret.Data {
+				if name := from.Prefix + key; isEnvVarName(name) {
+					ans[name] = EnvValue{
+						Value: string(value),
+						Secret: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: from.SecretRef.Name},
+							Key:                  key,
+						},
+					}
+				}
+			}
+		}
+	}
+	for _, env := range container.Env {
+		if env.ValueFrom == nil {
+			ans[env.Name] = EnvValue{Value: expandEnv(env.Value, ans)}
+			continue
+		}
+		from := env.ValueFrom
+		switch {
+		case from.SecretKeyRef != nil:
+			ref := from.SecretKeyRef
+			value := EnvValue{Secret: ref}
+			// The reference is kept when the Secret can't be read, as
+			// stores only need to point to it.
+			secret, err := sources.secret(ref.Name)
+			missing := apierrors.IsNotFound(err)
+			if err != nil {
+				value.Error = err.Error()
+			} else if data, ok := secret.Data[ref.Key]; ok {
+				value.Value = string(data)
+			} else {
+				value.Error = fmt.Sprintf("secret %v has no key %v", ref.Name, ref.Key)
+				missing = true
+			}
+			if missing && ref.Optional != nil && *ref.Optional {
+				continue
+			}
+			ans[env.Name] = value
+		case from.ConfigMapKeyRef != nil:
+			ref := from.ConfigMapKeyRef
+			cm, err := sources.configMap(ref.Name)
+			if err != nil {
+				if ref.Optional == nil || !*ref.Optional {
+					ans[env.Name] = EnvValue{Error: err.Error()}
+				}
+				continue
+			}
+			data, ok := cm.Data[ref.Key]
+			if !ok {
+				if ref.Optional == nil || !*ref.Optional {
+					ans[env.Name] = EnvValue{Error: fmt.Sprintf("configmap %v has no key %v", ref.Name, ref.Key)}
+				}
+				continue
+			}
+			ans[env.Name] = EnvValue{Value: data}
+		case from.FieldRef != nil:
+			value, err := podField(from.FieldRef.FieldPath, namespace, pod)
+			if err != nil {
+				ans[env.Name] = EnvValue{Error: err.Error()}
+				continue
+			}
+			ans[env.Name] = EnvValue{Value: value}
+		default:
+			ans[env.Name] = EnvValue{Error: "only secretKeyRef, configMapKeyRef and fieldRef can be read outside the pod"}
+		}
+	}
+	return ans, problems
+}
+
+// optionalMissing tells whether err is an optional source being absent,
+// which the kubelet ignores.
+func optionalMissing(optional *bool, err error) bool {
+	return apierrors.IsNotFound(err) && optional != nil && *optional
+}
+
+// envSources reads the Secrets and ConfigMaps of the environment once each.
+type envSources struct {
+	client     KesToEsoClient
+	ctx        context.Context
+	namespace  string
+	secrets    map[string]*corev1.Secret
+	configMaps map[string]*corev1.ConfigMap
+	readErrs   map[string]error
+}
+
+func newEnvSources(c KesToEsoClient, ctx context.Context, namespace string) *envSources {
+	return &envSources{
+		client:     c,
+		ctx:        ctx,
+		namespace:  namespace,
+		secrets:    make(map[string]*corev1.Secret),
+		configMaps: make(map[string]*corev1.ConfigMap),
+		readErrs:   make(map[string]error),
+	}
+}
+
+func (s *envSources) secret(name string) (*corev1.Secret, error) {
+	key := "secret/" + name
+	if secret, ok := s.secrets[name]; ok || s.readErrs[key] != nil {
+		return secret, s.readErrs[key]
+	}
+	secret, err := s.client.getSecret(s.ctx, s.namespace, name)
+	if err != nil {
+		s.readErrs[key] = err
+		return nil, err
+	}
+	s.secrets[name] = secret
+	return secret, nil
+}
+
+func (s *envSources) configMap(name string) (*corev1.ConfigMap, error) {
+	key := "configmap/" + name
+	if cm, ok := s.configMaps[name]; ok || s.readErrs[key] != nil {
+		return cm, s.readErrs[key]
+	}
+	cm, err := s.client.getConfigMap(s.ctx, s.namespace, name)
+	if err != nil {
+		s.readErrs[key] = err
+		return nil, err
+	}
+	s.configMaps[name] = cm
+	return cm, nil
+}
+
+func isEnvVarName(name string) bool {
+	return len(validation.IsEnvVarName(name)) == 0
+}
+
+// expandEnv expands $(VAR) references like the kubelet: references to
+// undefined variables are kept as they are and $$ escapes a $.
+func expandEnv(value string, env map[string]EnvValue) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 >= len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		switch value[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '(':
+			end := strings.IndexByte(value[i+2:], ')')
+			if end < 0 {
+				b.WriteString(value[i:])
+				return b.String()
+			}
+			name := value[i+2 : i+2+end]
+			if ref, ok := env[name]; ok && ref.Error == "" {
+				b.WriteString(ref.Value)
+			} else {
+				b.WriteString(value[i : i+3+end])
+			}
+			i += 2 + end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String()
+}
+
+var fieldSelector = regexp.MustCompile(`^metadata\.(labels|annotations)\['(.+)'\]$`)
+
+// podField reads the fields of the pod that are known before it runs.
+func podField(path string, namespace string, pod corev1.PodTemplateSpec) (string, error) {
+	switch path {
+	case "metadata.namespace":
+		return namespace, nil
+	case "spec.serviceAccountName":
+		return pod.Spec.ServiceAccountName, nil
+	}
+	if match := fieldSelector.FindStringSubmatch(path); match != nil {
+		if match[1] == "labels" {
+			return pod.ObjectMeta.Labels[match[2]], nil
+		}
+		return pod.ObjectMeta.Annotations[match[2]], nil
+	}
+	return "", fmt.Errorf("field %v is only known inside the pod", path)
+}
@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"context"
+	"kestoeso/pkg/apis"
+	"kestoeso/pkg/utils"
+	"testing"
+
+	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolveEnv(t *testing.T) {
+	optional := true
+	faker := testclient.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "kes-config", Namespace: "kes"},
+			Data:       map[string]string{"REGION": "eu-west-1", "LOG_LEVEL": "info", "not-a-var=": "x"},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "kes-creds", Namespace: "kes"},
+			Data:       map[string][]byte{"REGION": []byte("us-east-1"), "TOKEN": []byte("s3cr3t")},
+		},
+	)
+	c := KesToEsoClient{Client: faker, Options: apis.NewOptions()}
+	pod := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "kes"}},
+		Spec:       corev1.PodSpec{ServiceAccountName: "kes-sa"},
+	}
+	container := corev1.Container{
+		EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "kes-config"}}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "kes-creds"}}},
+			{Prefix: "KES_", SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "kes-creds"}}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "absent"}, Optional: &optional}},
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "gone"}}},
+		},
+		Env: []corev1.EnvVar{
+			{Name: "LOG_LEVEL", Value: "debug"},
+			{Name: "URL", Value: "https://$(REGION).example.com/$(UNSET)/$$(REGION)"},
+			{Name: "SETTING", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "kes-config"},
+				Key:                  "REGION",
+			}}},
+			{Name: "MISSING", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "kes-config"},
+				Key:                  "absent",
+				Optional:             &optional,
+			}}},
+			{Name: "NAMESPACE", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+			{Name: "APP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['app']"}}},
+			{Name: "SA", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.serviceAccountName"}}},
+			{Name: "POD_IP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
+			{Name: "CPU", ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{Resource: "limits.cpu"}}},
+		},
+	}
+	env, problems := c.resolveEnv(context.TODO(), "kes", pod, container)
+	// Only sources that are not optional keep the pod from starting.
+	if assert.Len(t, problems, 1) {
+		assert.Contains(t, problems[0], "envFrom ConfigMap gone")
+	}
+	// The Secret comes after the ConfigMap, and env after both.
+	assert.Equal(t, "us-east-1", env["REGION"].Value)
+	assert.Equal(t, "kes-creds", env["REGION"].Secret.Name)
+	assert.Equal(t, "debug", env["LOG_LEVEL"].Value)
+	assert.Nil(t, env["LOG_LEVEL"].Secret)
+	assert.Equal(t, "TOKEN", env["KES_TOKEN"].Secret.Key)
+	assert.Equal(t, "s3cr3t", env["KES_TOKEN"].Value)
+	assert.NotContains(t, env, "not-a-var=")
+	assert.Equal(t, "https://us-east-1.example.com/$(UNSET)/$(REGION)", env["URL"].Value)
+	assert.Equal(t, EnvValue{Value: "eu-west-1"}, env["SETTING"])
+	assert.NotContains(t, env, "MISSING")
+	assert.Equal(t, "kes", env["NAMESPACE"].Value)
+	assert.Equal(t, "kes", env["APP"].Value)
+	assert.Equal(t, "kes-sa", env["SA"].Value)
+	assert.NotEmpty(t, env["POD_IP"].Error)
+	assert.NotEmpty(t, env["CPU"].Error)
+}
+
+func TestAWSInstallEnvFrom(t *testing.T) {
+	opt := apis.NewOptions()
+	opt.Namespace = "kes"
+	opt.ToStdout = true
+	container := corev1.Container{
+		Name: opt.ContainerName,
+		EnvFrom: []corev1.EnvFromSource{
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "aws-creds"}}},
+		},
+		Env: []corev1.EnvVar{
+			{Name: "AWS_REGION", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.hostIP"}}},
+		},
+	}
+	deployment := appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: opt.DeploymentName, Namespace: "kes"}}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{container}
+	c := KesToEsoClient{Options: opt, KES: &KESManifests{
+		Deployments: []appsv1.Deployment{deployment},
+		Secrets: []corev1.Secret{{
+			ObjectMeta: metav1.ObjectMeta{Name: "aws-creds", Namespace: "kes"},
+			Data: map[string][]byte{
+				"AWS_ACCESS_KEY_ID":     []byte("id"),
+				"AWS_SECRET_ACCESS_KEY": []byte("secret"),
+			},
+		}},
+	}}
+	S := utils.NewSecretStore(false)
+	S.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{Service: api.AWSServiceSecretsManager}}
+	S, err := c.InstallAWSSecrets(context.TODO(), S)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "aws-creds", S.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Name)
+	assert.Equal(t, "AWS_ACCESS_KEY_ID", S.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Key)
+	assert.Equal(t, "aws-creds", S.Spec.Provider.AWS.Auth.SecretRef.SecretAccessKey.Name)
+	assert.Equal(t, "AWS_SECRET_ACCESS_KEY", S.Spec.Provider.AWS.Auth.SecretRef.SecretAccessKey.Key)
+}
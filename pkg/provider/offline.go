@@ -0,0 +1,293 @@
+package provider
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"kestoeso/pkg/apis"
+	"os"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	yaml "sigs.k8s.io/yaml"
+)
+
+// KESManifests holds the KES objects read from files instead of the cluster.
+// Credentials are then discovered from them, so generate runs without
+// cluster access.
+type KESManifests struct {
+	Deployments     []appsv1.Deployment
+	StatefulSets    []appsv1.StatefulSet
+	ServiceAccounts []corev1.ServiceAccount
+	Secrets         []corev1.Secret
+	ConfigMaps      []corev1.ConfigMap
+}
+
+// ReadKESDeploymentFile reads the Deployments and StatefulSets of a manifest
+// file, along with the ServiceAccounts, Secrets and ConfigMaps it holds.
+// Objects without a namespace belong to Options.Namespace.
+func ReadKESDeploymentFile(path string, options *apis.KesToEsoOptions) (*KESManifests, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ans := &KESManifests{}
+	decoder := k8syaml.NewYAMLOrJSONDecoder(bytes.NewReader(dat), 4096)
+	for {
+		obj := map[string]interface{}{}
+		err = decoder.Decode(&obj)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read %v: %w", path, err)
+		}
+		err = ans.add(obj, options.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %v: %w", path, err)
+		}
+	}
+	if len(ans.Deployments) == 0 && len(ans.StatefulSets) == 0 {
+		return nil, fmt.Errorf("no Deployment or StatefulSet found in %v", path)
+	}
+	return ans, nil
+}
+
+func (m *KESManifests) add(obj map[string]interface{}, namespace string) error {
+	kind, _ := obj["kind"].(string)
+	var err error
+	switch kind {
+	case "List":
+		items, _ := obj["items"].([]interface{})
+		for _, item := range items {
+			if item, ok := item.(map[string]interface{}); ok {
+				err = m.add(item, namespace)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case "Deployment":
+		deployment := appsv1.Deployment{}
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &deployment)
+		if deployment.ObjectMeta.Namespace == "" {
+			deployment.ObjectMeta.Namespace = namespace
+		}
+		m.Deployments = append(m.Deployments, deployment)
+	case "StatefulSet":
+		statefulSet := appsv1.StatefulSet{}
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &statefulSet)
+		if statefulSet.ObjectMeta.Namespace == "" {
+			statefulSet.ObjectMeta.Namespace = namespace
+		}
+		m.StatefulSets = append(m.StatefulSets, statefulSet)
+	case "ServiceAccount":
+		sa := corev1.ServiceAccount{}
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &sa)
+		if sa.ObjectMeta.Namespace == "" {
+			sa.ObjectMeta.Namespace = namespace
+		}
+		m.ServiceAccounts = append(m.ServiceAccounts, sa)
+	case "Secret":
+		secret := corev1.Secret{}
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &secret)
+		if secret.ObjectMeta.Namespace == "" {
+			secret.ObjectMeta.Namespace = namespace
+		}
+		for key, value := range secret.StringData {
+			if secret.Data == nil {
+				secret.Data = map[string][]byte{}
+			}
+			secret.Data[key] = []byte(value)
+		}
+		m.Secrets = append(m.Secrets, secret)
+	case "ConfigMap":
+		cm := corev1.ConfigMap{}
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &cm)
+		if cm.ObjectMeta.Namespace == "" {
+			cm.ObjectMeta.Namespace = namespace
+		}
+		m.ConfigMaps = append(m.ConfigMaps, cm)
+	}
+	return err
+}
+
+// kesHelmValues is the part of the values of the kubernetes-external-secrets
+// chart that tells how KES reads its credentials.
+type kesHelmValues struct {
+	Env               map[string]interface{} `json:"env"`
+	EnvFrom           []corev1.EnvFromSource `json:"envFrom"`
+	EnvVarsFromSecret map[string]struct {
+		SecretKeyRef string `json:"secretKeyRef"`
+		Key          string `json:"key"`
+	} `json:"envVarsFromSecret"`
+	FilesFromSecret map[string]struct {
+		Secret    string `json:"secret"`
+		MountPath string `json:"mountPath"`
+	} `json:"filesFromSecret"`
+	ServiceAccount struct {
+		Create      *bool             `json:"create"`
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"serviceAccount"`
+	PodAnnotations map[string]string `json:"podAnnotations"`
+}
+
+// ReadKESHelmValues builds the KES Deployment and ServiceAccount that the
+// kubernetes-external-secrets chart renders from a values file. The
+// Deployment is named Options.DeploymentName, as the release name is not
+// part of the values.
+func ReadKESHelmValues(path string, options *apis.KesToEsoOptions) (*KESManifests, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := kesHelmValues{}
+	err = yaml.Unmarshal(dat, &values)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %v: %w", path, err)
+	}
+	container := corev1.Container{Name: options.ContainerName, EnvFrom: values.EnvFrom}
+	for _, name := range sortedKeys(values.Env) {
+		if values.Env[name] == nil {
+			continue
+		}
+		container.Env = append(container.Env, corev1.EnvVar{Name: name, Value: fmt.Sprint(values.Env[name])})
+	}
+	envFromSecret := make([]string, 0, len(values.EnvVarsFromSecret))
+	for name := range values.EnvVarsFromSecret {
+		envFromSecret = append(envFromSecret, name)
+	}
+	sort.Strings(envFromSecret)
+	for _, name := range envFromSecret {
+		ref := values.EnvVarsFromSecret[name]
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: ref.SecretKeyRef},
+				Key:                  ref.Key,
+			}},
+		})
+	}
+	podSpec := corev1.PodSpec{}
+	files := make([]string, 0, len(values.FilesFromSecret))
+	for name := range values.FilesFromSecret {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		file := values.FilesFromSecret[name]
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: file.MountPath, ReadOnly: true})
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: file.Secret}},
+		})
+	}
+	podSpec.Containers = []corev1.Container{container}
+	// The chart names its ServiceAccount after the release unless told
+	// otherwise, and uses the default one when it does not create it.
+	create := values.ServiceAccount.Create == nil || *values.ServiceAccount.Create
+	podSpec.ServiceAccountName = values.ServiceAccount.Name
+	if podSpec.ServiceAccountName == "" {
+		podSpec.ServiceAccountName = "default"
+		if create {
+			podSpec.ServiceAccountName = options.DeploymentName
+		}
+	}
+	ans := &KESManifests{
+		Deployments: []appsv1.Deployment{{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Name: options.DeploymentName, Namespace: options.Namespace},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: values.PodAnnotations},
+				Spec:       podSpec,
+			}},
+		}},
+	}
+	if create {
+		ans.ServiceAccounts = append(ans.ServiceAccounts, corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        podSpec.ServiceAccountName,
+				Namespace:   options.Namespace,
+				Annotations: values.ServiceAccount.Annotations,
+			},
+		})
+	}
+	return ans, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	ans := make([]string, 0, len(m))
+	for key := range m {
+		ans = append(ans, key)
+	}
+	sort.Strings(ans)
+	return ans
+}
+
+// workload returns the Deployment or StatefulSet called name, or the only
+// workload when a single one was read.
+func (m *KESManifests) workload(kind string, namespace string, name string) (metav1.ObjectMeta, corev1.PodTemplateSpec, error) {
+	if kind == "" {
+		kind = "Deployment"
+	}
+	workloads := m.workloads()
+	for _, w := range workloads {
+		if w.kind == kind && w.meta.Name == name && w.meta.Namespace == namespace {
+			return w.meta, w.template, nil
+		}
+	}
+	if len(workloads) == 1 {
+		return workloads[0].meta, workloads[0].template, nil
+	}
+	return metav1.ObjectMeta{}, corev1.PodTemplateSpec{}, fmt.Errorf("no KES %v %v/%v in the given manifests", kind, namespace, name)
+}
+
+type workload struct {
+	kind     string
+	meta     metav1.ObjectMeta
+	template corev1.PodTemplateSpec
+}
+
+func (m *KESManifests) workloads() []workload {
+	ans := make([]workload, 0, len(m.Deployments)+len(m.StatefulSets))
+	for _, deployment := range m.Deployments {
+		ans = append(ans, workload{"Deployment", deployment.ObjectMeta, deployment.Spec.Template})
+	}
+	for _, statefulSet := range m.StatefulSets {
+		ans = append(ans, workload{"StatefulSet", statefulSet.ObjectMeta, statefulSet.Spec.Template})
+	}
+	return ans
+}
+
+func (m *KESManifests) serviceAccount(namespace string, name string) *corev1.ServiceAccount {
+	for i, sa := range m.ServiceAccounts {
+		if sa.ObjectMeta.Name == name && sa.ObjectMeta.Namespace == namespace {
+			return &m.ServiceAccounts[i]
+		}
+	}
+	return nil
+}
+
+func (m *KESManifests) secret(namespace string, name string) *corev1.Secret {
+	for i, secret := range m.Secrets {
+		if secret.ObjectMeta.Name == name && secret.ObjectMeta.Namespace == namespace {
+			return &m.Secrets[i]
+		}
+	}
+	return nil
+}
+
+func (m *KESManifests) configMap(namespace string, name string) *corev1.ConfigMap {
+	for i, cm := range m.ConfigMaps {
+		if cm.ObjectMeta.Name == name && cm.ObjectMeta.Namespace == namespace {
+			return &m.ConfigMaps[i]
+		}
+	}
+	return nil
+}
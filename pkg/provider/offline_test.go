@@ -0,0 +1,156 @@
+package provider
+
+import (
+	"context"
+	"kestoeso/pkg/apis"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadKESDeploymentFile(t *testing.T) {
+	ctx := context.TODO()
+	opt := apis.NewOptions()
+	opt.Namespace = "kes-ns"
+	opt.ToStdout = true
+	kes, err := ReadKESDeploymentFile("testdata/kes-deployment.yaml", opt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, kes.Deployments, 1)
+	assert.Equal(t, "kes-ns", kes.Deployments[0].ObjectMeta.Namespace)
+	assert.Len(t, kes.ServiceAccounts, 1)
+	assert.Len(t, kes.Secrets, 1)
+	c := KesToEsoClient{Options: opt, KES: kes}
+
+	S := api.SecretStore{}
+	S.Spec.Provider = &api.SecretStoreProvider{Vault: &api.VaultProvider{}}
+	S, err = c.InstallVaultSecrets(ctx, S)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://vault.example.com:8200", S.Spec.Provider.Vault.Server)
+	assert.Equal(t, "kes", S.Spec.Provider.Vault.Auth.Kubernetes.Role)
+	assert.Equal(t, "kes", S.Spec.Provider.Vault.Auth.Kubernetes.ServiceAccountRef.Name)
+
+	S = api.SecretStore{}
+	S.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{}}
+	S, err = c.InstallAWSSecrets(ctx, S)
+	assert.NoError(t, err)
+	if assert.NotNil(t, S.Spec.Provider.AWS.Auth.JWTAuth) {
+		assert.Equal(t, "kes", S.Spec.Provider.AWS.Auth.JWTAuth.ServiceAccountRef.Name)
+	}
+
+	instances, err := c.DiscoverKESInstances(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]KESWorkload{"": {Kind: "Deployment", Namespace: "kes-ns", Name: "kubernetes-external-secrets", Container: "kubernetes-external-secrets"}}, instances)
+}
+
+func TestReadKESDeploymentFileMissingSecret(t *testing.T) {
+	ctx := context.TODO()
+	opt := apis.NewOptions()
+	opt.Namespace = "other-ns"
+	kes, err := ReadKESDeploymentFile("testdata/kes-deployment.yaml", opt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Without a cluster, secrets missing from the manifests can't be read.
+	c := KesToEsoClient{Options: opt, KES: kes}
+	_, err = c.GetSecretValue(ctx, "vault-config", "addr", "kes-ns")
+	assert.ErrorIs(t, err, errNoCluster)
+}
+
+func TestReadKESDeploymentFileOtherNamespace(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "kes.yaml")
+	err := os.WriteFile(path, []byte(`apiVersion: v1
+kind: Secret
+metadata:
+  name: aws-creds
+  namespace: kes
+stringData:
+  ACCESS_KEY_ID: AKIA
+  SECRET_ACCESS_KEY: s3cr3t
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: kubernetes-external-secrets
+  namespace: kes
+spec:
+  template:
+    spec:
+      containers:
+      - name: kubernetes-external-secrets
+        envFrom:
+        - secretRef:
+            name: aws-creds
+          prefix: AWS_
+`), 0644)
+	assert.NoError(t, err)
+	// The workload is found whatever --kes-namespace, its Secrets must be too.
+	opt := apis.NewOptions()
+	opt.ToStdout = true
+	kes, err := ReadKESDeploymentFile(path, opt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := KesToEsoClient{Options: opt, KES: kes}
+	profile, err := c.KESProfile(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "kes", profile.Namespace)
+		assert.Equal(t, "AKIA", profile.Lookup("AWS_ACCESS_KEY_ID").Value)
+	}
+	S := api.SecretStore{}
+	S.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{}}
+	S, err = c.InstallAWSSecrets(ctx, S)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "aws-creds", S.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Name)
+		assert.Equal(t, "kes", *S.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Namespace)
+	}
+}
+
+func TestReadKESHelmValues(t *testing.T) {
+	ctx := context.TODO()
+	opt := apis.NewOptions()
+	opt.Namespace = "kes-ns"
+	opt.DeploymentName = "kes-kubernetes-external-secrets"
+	opt.ToStdout = true
+	kes, err := ReadKESHelmValues("testdata/kes-values.yaml", opt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	deployment := kes.Deployments[0]
+	assert.Equal(t, "kes-kubernetes-external-secrets", deployment.ObjectMeta.Name)
+	assert.Equal(t, "kes-kubernetes-external-secrets", deployment.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, map[string]string{"team": "platform"}, deployment.Spec.Template.ObjectMeta.Annotations)
+	container := deployment.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, opt.ContainerName, container.Name)
+	names := []string{}
+	for _, env := range container.Env {
+		names = append(names, env.Name)
+	}
+	assert.Equal(t, []string{"AWS_REGION", "GOOGLE_APPLICATION_CREDENTIALS", "LOG_LEVEL", "POLLER_INTERVAL_MILLISECONDS", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"}, names)
+	assert.Equal(t, "10000", container.Env[3].Value)
+	c := KesToEsoClient{Options: opt, KES: kes}
+
+	S := api.SecretStore{}
+	S.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{}}
+	S, err = c.InstallAWSSecrets(ctx, S)
+	assert.NoError(t, err)
+	assert.Equal(t, "kes-aws-secrets", S.Spec.Provider.AWS.Auth.SecretRef.AccessKeyID.Name)
+	assert.Equal(t, "secret-access-key", S.Spec.Provider.AWS.Auth.SecretRef.SecretAccessKey.Key)
+
+	S = api.SecretStore{}
+	S.Spec.Provider = &api.SecretStoreProvider{GCPSM: &api.GCPSMProvider{}}
+	S, err = c.InstallGCPSMSecrets(ctx, S)
+	assert.NoError(t, err)
+	assert.Equal(t, "kes-gcp-creds", S.Spec.Provider.GCPSM.Auth.SecretRef.SecretAccessKey.Name)
+	assert.Equal(t, "gcp-creds.json", S.Spec.Provider.GCPSM.Auth.SecretRef.SecretAccessKey.Key)
+
+	sa := kes.serviceAccount("kes-ns", "kes-kubernetes-external-secrets")
+	if assert.NotNil(t, sa) {
+		assert.Equal(t, "arn:aws:iam::123412341234:role/kes", sa.Annotations["eks.amazonaws.com/role-arn"])
+	}
+}
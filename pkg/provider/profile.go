@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// KESProfile is what credential discovery needs to know about a KES
+// deployment. It is read once per run and instance, and every provider
+// derives its auth from it.
+type KESProfile struct {
+	Namespace          string
+	DeploymentName     string
+	Container          corev1.Container // the KES container, empty when missing
+	Volumes            []corev1.Volume
+	ServiceAccountName string
+	ServiceAccount     *corev1.ServiceAccount // nil when it could not be read
+	Annotations        map[string]string      // annotations of the pod template
+	Env                map[string]EnvValue    // environment of the KES container
+	EnvProblems        []string               // why envFrom sources could not be read
+}
+
+// Lookup returns the env var name of the KES container, which is empty when
+// the container doesn't set it.
+func (p *KESProfile) Lookup(name string) EnvValue {
+	return p.Env[name]
+}
+
+// Value returns the value of the env var name, which is empty when the KES
+// container doesn't set it.
+func (p *KESProfile) Value(name string) (string, error) {
+	env := p.Env[name]
+	if env.Error != "" {
+		return "", fmt.Errorf("%v: %v", name, env.Error)
+	}
+	return env.Value, nil
+}
+
+// HasServiceAccountAnnotation tells whether the KES ServiceAccount has the
+// annotation key.
+func (p *KESProfile) HasServiceAccountAnnotation(key string) bool {
+	if p.ServiceAccount == nil {
+		return false
+	}
+	_, ok := p.ServiceAccount.Annotations[key]
+	return ok
+}
+
+// ProfileCache keeps the profile of each KES deployment for a run. It is
+// safe for concurrent use.
+type ProfileCache struct {
+	mu       sync.Mutex
+	profiles map[string]*cachedProfile
+}
+
+type cachedProfile struct {
+	once    sync.Once
+	profile *KESProfile
+	err     error
+}
+
+func NewProfileCache() *ProfileCache {
+	return &ProfileCache{profiles: make(map[string]*cachedProfile)}
+}
+
+func (cache *ProfileCache) get(key string) *cachedProfile {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.profiles[key]
+	if !ok {
+		entry = &cachedProfile{}
+		cache.profiles[key] = entry
+	}
+	return entry
+}
+
+// KESProfile returns the profile of the KES deployment, read only once per
+// run when the client has a ProfileCache.
+func (c KesToEsoClient) KESProfile(ctx context.Context) (*KESProfile, error) {
+	if c.Profiles == nil {
+		return c.readKESProfile(ctx)
+	}
+	key := fmt.Sprintf("%v/%v/%v/%v", c.Options.WorkloadKind, c.Options.Namespace, c.Options.DeploymentName, c.Options.ContainerName)
+	entry := c.Profiles.get(key)
+	entry.once.Do(func() {
+		entry.profile, entry.err = c.readKESProfile(ctx)
+	})
+	return entry.profile, entry.err
+}
+
+func (c KesToEsoClient) readKESProfile(ctx context.Context) (*KESProfile, error) {
+	meta, template, err := c.GetKESWorkload(ctx)
+	if err != nil {
+		return nil, err
+	}
+	podSpec := template.Spec
+	ans := &KESProfile{
+		Namespace:          meta.Namespace,
+		DeploymentName:     meta.Name,
+		Volumes:            podSpec.Volumes,
+		ServiceAccountName: podSpec.ServiceAccountName,
+		Annotations:        template.ObjectMeta.Annotations,
+	}
+	for _, container := range podSpec.Containers {
+		if container.Name == c.Options.ContainerName {
+			ans.Container = container
+		}
+	}
+	if ans.ServiceAccountName != "" {
+		ans.ServiceAccount, _ = c.getServiceAccount(ctx, ans.Namespace, ans.ServiceAccountName)
+	}
+	ans.Env, ans.EnvProblems = c.resolveEnv(ctx, ans.Namespace, template, ans.Container)
+	return ans, nil
+}
@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"context"
+	"kestoeso/pkg/apis"
+	"sync"
+	"testing"
+
+	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newProfileObjects() []runtime.Object {
+	container := corev1.Container{
+		Name: "kubernetes-external-secrets",
+		Env: []corev1.EnvVar{
+			{Name: "VAULT_ADDR", Value: "https://old.example.com"},
+			{Name: "VAULT_ADDR", Value: "https://vault.example.com"},
+			{Name: "DEFAULT_VAULT_MOUNT_POINT", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "vault-config"},
+				Key:                  "mount",
+			}}},
+			{Name: "DEFAULT_VAULT_ROLE", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "vault-config"},
+				Key:                  "role",
+			}}},
+			{Name: "AWS_ACCESS_KEY_ID", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+				Key:                  "id",
+			}}},
+		},
+	}
+	return []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubernetes-external-secrets", Namespace: "kes"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"team": "platform"}},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: "kes-sa",
+					Containers:         []corev1.Container{{Name: "sidecar"}, container},
+				},
+			}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "vault-config", Namespace: "kes"},
+			Data:       map[string][]byte{"mount": []byte("kubernetes"), "role": []byte("kes")},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: "kes-sa", Namespace: "kes"},
+		},
+	}
+}
+
+func TestKESProfile(t *testing.T) {
+	ctx := context.TODO()
+	opt := apis.NewOptions()
+	opt.Namespace = "kes"
+	c := KesToEsoClient{Client: testclient.NewSimpleClientset(newProfileObjects()...), Options: opt}
+	profile, err := c.KESProfile(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "kes", profile.Namespace)
+	assert.Equal(t, "kubernetes-external-secrets", profile.Container.Name)
+	assert.Equal(t, "kes-sa", profile.ServiceAccount.ObjectMeta.Name)
+	assert.Equal(t, map[string]string{"team": "platform"}, profile.Annotations)
+	assert.Equal(t, "https://vault.example.com", profile.Lookup("VAULT_ADDR").Value)
+	assert.Equal(t, "kubernetes", profile.Lookup("DEFAULT_VAULT_MOUNT_POINT").Value)
+	assert.Equal(t, "vault-config", profile.Lookup("DEFAULT_VAULT_ROLE").Secret.Name)
+	assert.Equal(t, "missing", profile.Lookup("AWS_ACCESS_KEY_ID").Secret.Name)
+	assert.NotEmpty(t, profile.Lookup("AWS_ACCESS_KEY_ID").Error)
+	_, err = profile.Value("AWS_ACCESS_KEY_ID")
+	assert.Error(t, err)
+	value, err := profile.Value("UNSET")
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+}
+
+func TestKESProfileCache(t *testing.T) {
+	ctx := context.TODO()
+	opt := apis.NewOptions()
+	opt.Namespace = "kes"
+	faker := testclient.NewSimpleClientset(newProfileObjects()...)
+	var mu sync.Mutex
+	gets := map[string]int{}
+	faker.PrependReactor("get", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		gets[action.GetResource().Resource]++
+		return false, nil, nil
+	})
+	c := KesToEsoClient{Client: faker, Options: opt, Profiles: NewProfileCache()}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			S := api.SecretStore{}
+			S.Spec.Provider = &api.SecretStoreProvider{Vault: &api.VaultProvider{}}
+			S, err := c.InstallVaultSecrets(ctx, S)
+			assert.NoError(t, err)
+			assert.Equal(t, "https://vault.example.com", S.Spec.Provider.Vault.Server)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, map[string]int{"deployments": 1, "secrets": 2, "serviceaccounts": 1}, gets)
+}
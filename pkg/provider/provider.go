@@ -6,22 +6,100 @@ import (
 	"fmt"
 	"kestoeso/pkg/apis"
 	"kestoeso/pkg/utils"
+	"regexp"
 	"strings"
 
 	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
 	esmeta "github.com/external-secrets/external-secrets/apis/meta/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
 type KesToEsoClient struct {
-	Options *apis.KesToEsoOptions
-	Client  kubernetes.Interface
+	Options       *apis.KesToEsoOptions
+	Client        kubernetes.Interface
+	DynamicClient dynamic.Interface
+	Instances     map[string]KESWorkload // KES workloads by INSTANCE_ID
+	KES           *KESManifests          // KES objects read from files, used instead of the cluster
+	Profiles      *ProfileCache          // KES profiles read during the run, read again each time when nil
+	// Output keeps the credential Secrets to write, when set, instead of
+	// writing them right away.
+	Output *utils.ManifestBuffer
+}
+
+func (c KesToEsoClient) writeManifest(obj interface{}, filename string) error {
+	if c.Output != nil {
+		c.Output.Add(obj, filename)
+		return nil
+	}
+	return utils.WriteYaml(obj, filename, c.Options.ToStdout)
+}
+
+// errNoCluster is returned when an object is missing from the KES manifests
+// and there is no cluster to read it from.
+var errNoCluster = errors.New("not found in the KES manifests and no cluster access")
+
+// GetKESWorkload returns the metadata and pod template of the KES
+// Deployment, or StatefulSet when Options.WorkloadKind says so. They are read
+// from the KES manifests when they were given.
+func (c KesToEsoClient) GetKESWorkload(ctx context.Context) (metav1.ObjectMeta, corev1.PodTemplateSpec, error) {
+	if c.KES != nil {
+		return c.KES.workload(c.Options.WorkloadKind, c.Options.Namespace, c.Options.DeploymentName)
+	}
+	if c.Options.WorkloadKind == "StatefulSet" {
+		statefulSet, err := c.Client.AppsV1().StatefulSets(c.Options.Namespace).Get(ctx, c.Options.DeploymentName, metav1.GetOptions{})
+		if err != nil {
+			return metav1.ObjectMeta{}, corev1.PodTemplateSpec{}, err
+		}
+		return statefulSet.ObjectMeta, statefulSet.Spec.Template, nil
+	}
+	deployment, err := c.Client.AppsV1().Deployments(c.Options.Namespace).Get(ctx, c.Options.DeploymentName, metav1.GetOptions{})
+	if err != nil {
+		return metav1.ObjectMeta{}, corev1.PodTemplateSpec{}, err
+	}
+	return deployment.ObjectMeta, deployment.Spec.Template, nil
+}
+
+func (c KesToEsoClient) getSecret(ctx context.Context, namespace string, name string) (*corev1.Secret, error) {
+	if c.KES != nil {
+		if secret := c.KES.secret(namespace, name); secret != nil {
+			return secret, nil
+		}
+	}
+	if c.Client == nil {
+		return nil, fmt.Errorf("secret %v/%v: %w", namespace, name, errNoCluster)
+	}
+	return c.Client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c KesToEsoClient) getConfigMap(ctx context.Context, namespace string, name string) (*corev1.ConfigMap, error) {
+	if c.KES != nil {
+		if cm := c.KES.configMap(namespace, name); cm != nil {
+			return cm, nil
+		}
+	}
+	if c.Client == nil {
+		return nil, fmt.Errorf("configmap %v/%v: %w", namespace, name, errNoCluster)
+	}
+	return c.Client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c KesToEsoClient) getServiceAccount(ctx context.Context, namespace string, name string) (*corev1.ServiceAccount, error) {
+	if c.KES != nil {
+		if sa := c.KES.serviceAccount(namespace, name); sa != nil {
+			return sa, nil
+		}
+	}
+	if c.Client == nil {
+		return nil, fmt.Errorf("service account %v/%v: %w", namespace, name, errNoCluster)
+	}
+	return c.Client.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
 }
 
 func (c KesToEsoClient) GetSecretValue(ctx context.Context, name string, key string, namespace string) (string, error) {
-	secret, err := c.Client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	secret, err := c.getSecret(ctx, namespace, name)
 	if err != nil {
 		return "", err
 	}
@@ -30,7 +108,7 @@ func (c KesToEsoClient) GetSecretValue(ctx context.Context, name string, key str
 }
 
 func (c KesToEsoClient) GetServiceAccountIfAnnotationExists(ctx context.Context, key string, sa *esmeta.ServiceAccountSelector) (*corev1.ServiceAccount, error) {
-	s, err := c.Client.CoreV1().ServiceAccounts(*sa.Namespace).Get(ctx, sa.Name, metav1.GetOptions{})
+	s, err := c.getServiceAccount(ctx, *sa.Namespace, sa.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -42,172 +120,144 @@ func (c KesToEsoClient) GetServiceAccountIfAnnotationExists(ctx context.Context,
 	}
 }
 
+// awsKeySelector returns where a store reads an AWS key from: the Secret key
+// env comes from, or key of the aws-secrets Secret for a literal, which is
+// returned as well.
+func awsKeySelector(env EnvValue, key string) (esmeta.SecretKeySelector, string) {
+	if ref := env.Secret; ref != nil {
+		return esmeta.SecretKeySelector{Name: ref.Name, Key: ref.Key}, ""
+	}
+	if env.Value != "" {
+		return esmeta.SecretKeySelector{Name: "aws-secrets", Key: key}, env.Value
+	}
+	return esmeta.SecretKeySelector{}, ""
+}
+
 func (c KesToEsoClient) InstallAWSSecrets(ctx context.Context, S api.SecretStore) (api.SecretStore, error) {
 	ans := S
-	deployment, err := c.Client.AppsV1().Deployments(c.Options.Namespace).Get(ctx, c.Options.DeploymentName, metav1.GetOptions{})
+	profile, err := c.KESProfile(ctx)
 	if err != nil {
 		return S, err
 	}
-	containers := deployment.Spec.Template.Spec.Containers
-	var accessKeyIdSecretKeyRefKey, accessKeyIdSecretKeyRefName string
-	var secretAccessKeySecretKeyRefKey, secretAccessKeySecretKeyRefName string
-	var newsecret = &corev1.Secret{}
-	for _, container := range containers {
-		if container.Name == c.Options.ContainerName {
-			containerEnvs := container.Env
-			for _, env := range containerEnvs {
-				if env.Name == "AWS_ACCESS_KEY_ID" {
-					if env.ValueFrom != nil {
-						accessKeyIdSecretKeyRefName = env.ValueFrom.SecretKeyRef.Name
-						accessKeyIdSecretKeyRefKey = env.ValueFrom.SecretKeyRef.Key
-					} else if env.Value != "" {
-						accessKeyIdSecretKeyRefName = "aws-secrets"
-						accessKeyIdSecretKeyRefKey = "access-key-id"
-						ns := c.Options.Namespace
-						if c.Options.TargetNamespace != "" {
-							ns = c.Options.TargetNamespace
-						}
-						keySelector := esmeta.SecretKeySelector{
-							Name:      accessKeyIdSecretKeyRefName,
-							Namespace: &ns,
-							Key:       accessKeyIdSecretKeyRefKey,
-						}
-						newsecret, err = utils.UpdateOrCreateSecret(newsecret, &keySelector, env.Value)
-						if err != nil {
-							return S, err
-						}
-					}
-				}
-				if env.Name == "AWS_SECRET_ACCESS_KEY" {
-					if env.ValueFrom != nil {
-						secretAccessKeySecretKeyRefName = env.ValueFrom.SecretKeyRef.Name
-						secretAccessKeySecretKeyRefKey = env.ValueFrom.SecretKeyRef.Key
-					} else if env.Value != "" {
-						secretAccessKeySecretKeyRefName = "aws-secrets"
-						secretAccessKeySecretKeyRefKey = "secret-access-key"
-						ns := c.Options.Namespace
-						if c.Options.TargetNamespace != "" {
-							ns = c.Options.TargetNamespace
-						}
-						secretSelector := esmeta.SecretKeySelector{
-							Name:      secretAccessKeySecretKeyRefName,
-							Namespace: &ns,
-							Key:       secretAccessKeySecretKeyRefKey,
-						}
-						newsecret, err = utils.UpdateOrCreateSecret(newsecret, &secretSelector, env.Value)
-						if err != nil {
-							return S, err
-						}
-					}
-				}
-				if accessKeyIdSecretKeyRefName != "" && secretAccessKeySecretKeyRefName != "" {
-					break
-				}
-			}
-			break
-		}
+	kesNamespace := profile.Namespace
+	ns := kesNamespace
+	if c.Options.TargetNamespace != "" {
+		ns = c.Options.TargetNamespace
 	}
-	awsSecretRef := api.AWSAuthSecretRef{
-		AccessKeyID: esmeta.SecretKeySelector{
-			Name:      accessKeyIdSecretKeyRefName,
-			Key:       accessKeyIdSecretKeyRefKey,
-			Namespace: &c.Options.Namespace,
-		},
-		SecretAccessKey: esmeta.SecretKeySelector{
-			Name:      secretAccessKeySecretKeyRefName,
-			Key:       secretAccessKeySecretKeyRefKey,
-			Namespace: &c.Options.Namespace,
-		},
-	}
-	ans.Spec.Provider.AWS.Auth.SecretRef = &awsSecretRef
-	if newsecret.ObjectMeta.Name != "" {
-		secret_filename := fmt.Sprintf("%v/secret-%v.yaml", c.Options.OutputPath, newsecret.ObjectMeta.Name)
-		err := utils.WriteYaml(newsecret, secret_filename, c.Options.ToStdout)
-		if err != nil {
-			return ans, err
+	accessKeyID, accessKeyIDValue := awsKeySelector(profile.Lookup("AWS_ACCESS_KEY_ID"), "access-key-id")
+	secretAccessKey, secretAccessKeyValue := awsKeySelector(profile.Lookup("AWS_SECRET_ACCESS_KEY"), "secret-access-key")
+	if accessKeyID.Name != "" && secretAccessKey.Name != "" {
+		// Literal keys are only written once both keys are known, a
+		// single one would be of no use.
+		newsecret := &corev1.Secret{}
+		literals := []struct {
+			selector esmeta.SecretKeySelector
+			value    string
+		}{{accessKeyID, accessKeyIDValue}, {secretAccessKey, secretAccessKeyValue}}
+		for _, literal := range literals {
+			if literal.value == "" {
+				continue
+			}
+			selector := literal.selector
+			selector.Namespace = &ns
+			newsecret, err = utils.UpdateOrCreateSecret(newsecret, &selector, literal.value)
+			if err != nil {
+				return S, err
+			}
 		}
-	}
-	if awsSecretRef.AccessKeyID.Name == "" || awsSecretRef.SecretAccessKey.Name == "" {
-		saSelector := esmeta.ServiceAccountSelector{
-			Namespace: &c.Options.Namespace,
-			Name:      deployment.Spec.Template.Spec.ServiceAccountName,
+		if newsecret.ObjectMeta.Name != "" {
+			secret_filename := utils.OutputFile(c.Options, "", fmt.Sprintf("secret-%v.yaml", newsecret.ObjectMeta.Name))
+			err := c.writeManifest(newsecret, secret_filename)
+			if err != nil {
+				return S, err
+			}
 		}
-		_, err := c.GetServiceAccountIfAnnotationExists(ctx, "eks.amazonaws.com/role-arn", &saSelector) // Later On with --copy-secret-auths we can use SA to change namespaces and apply
-		if err != nil {
-			return S, errors.New("could not find aws credential information (secrets or sa with role-arn annotation) on kes deployment")
+		accessKeyID.Namespace = &kesNamespace
+		secretAccessKey.Namespace = &kesNamespace
+		ans.Spec.Provider.AWS.Auth.SecretRef = &api.AWSAuthSecretRef{
+			AccessKeyID:     accessKeyID,
+			SecretAccessKey: secretAccessKey,
 		}
+		return ans, nil
+	}
+	saSelector := esmeta.ServiceAccountSelector{
+		Namespace: &kesNamespace,
+		Name:      profile.ServiceAccountName,
+	}
+	// Later On with --copy-secret-auths we can use SA to change namespaces and apply
+	if profile.HasServiceAccountAnnotation("eks.amazonaws.com/role-arn") {
 		JWTAuth := api.AWSJWTAuth{ServiceAccountRef: &saSelector}
 		ans.Spec.Provider.AWS.Auth.JWTAuth = &JWTAuth
+		return ans, nil
+	}
+	// With kube2iam or kiam, KES runs with the role of its pod
+	// annotation. ESO pods get the same role from the same annotation,
+	// and the store reads with the controller credentials.
+	role, ok := profile.Annotations[AWSPodRoleAnnotation]
+	if !ok {
+		if accessKeyID.Name != "" || secretAccessKey.Name != "" {
+			return S, errors.New("kes deployment only sets one of AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return S, errors.New("could not find aws credential information (secrets, sa with role-arn annotation or pod with iam.amazonaws.com/role annotation) on kes deployment")
+	}
+	if ans.Spec.Provider.AWS.Role == "" && strings.HasPrefix(role, "arn:") {
+		ans.Spec.Provider.AWS.Role = role
 	}
 	return ans, nil
 }
 
+// AWSPodRoleAnnotation is the pod annotation kube2iam and kiam read the IAM
+// role of a pod from.
+const AWSPodRoleAnnotation = "iam.amazonaws.com/role"
+
+// AWSPodRole returns the kube2iam or kiam role of the KES pods, if any.
+func (c KesToEsoClient) AWSPodRole(ctx context.Context) string {
+	profile, err := c.KESProfile(ctx)
+	if err != nil {
+		return ""
+	}
+	return profile.Annotations[AWSPodRoleAnnotation]
+}
+
 func (c KesToEsoClient) InstallVaultSecrets(ctx context.Context, S api.SecretStore) (api.SecretStore, error) {
 	ans := S
 	authRef := api.VaultKubernetesAuth{}
-	deployment, err := c.Client.AppsV1().Deployments(c.Options.Namespace).Get(ctx, c.Options.DeploymentName, metav1.GetOptions{})
+	profile, err := c.KESProfile(ctx)
 	if err != nil {
 		return S, err
 	}
 	newsecret := &corev1.Secret{}
-	containers := deployment.Spec.Template.Spec.Containers
-	serviceAccountName := deployment.Spec.Template.Spec.ServiceAccountName
-	serviceAccountNS := deployment.ObjectMeta.Namespace
+	serviceAccountNS := profile.Namespace
 	serviceAccountRef := esmeta.ServiceAccountSelector{
-		Name:      serviceAccountName,
+		Name:      profile.ServiceAccountName,
 		Namespace: &serviceAccountNS,
 	}
 	authRef.ServiceAccountRef = &serviceAccountRef
-	for _, container := range containers {
-		if container.Name == c.Options.ContainerName {
-			envs := container.Env
-			for _, env := range envs {
-				if env.Name == "VAULT_ADDR" {
-					if env.Value != "" {
-						ans.Spec.Provider.Vault.Server = env.Value
-					} else if env.ValueFrom != nil {
-						key := env.ValueFrom.SecretKeyRef.Key
-						name := env.ValueFrom.SecretKeyRef.Name
-						value, err := c.GetSecretValue(ctx, name, key, c.Options.Namespace)
-						if err != nil {
-							return S, errors.New("could not find env value for vault_addr")
-						}
-						ans.Spec.Provider.Vault.Server = value
-					}
-				}
-				if env.Name == "DEFAULT_VAULT_MOUNT_POINT" {
-					if env.ValueFrom != nil {
-						key := env.ValueFrom.SecretKeyRef.Key
-						name := env.ValueFrom.SecretKeyRef.Name
-						value, err := c.GetSecretValue(ctx, name, key, c.Options.Namespace)
-						if err != nil {
-							return S, errors.New("could not find secret value for default_vault_mount_point")
-						}
-						authRef.Path = value
-					} else if env.Value != "" {
-						authRef.Path = env.Value
-					}
-				}
-				if env.Name == "DEFAULT_VAULT_ROLE" {
-					if env.ValueFrom != nil {
-						key := env.ValueFrom.SecretKeyRef.Key
-						name := env.ValueFrom.SecretKeyRef.Name
-						value, err := c.GetSecretValue(ctx, name, key, c.Options.Namespace)
-						if err != nil {
-							return S, errors.New("could not find secret value for default_vault_role")
-						}
-						authRef.Role = value
-					} else if env.Value != "" {
-						authRef.Role = env.Value
-					}
-				}
-			}
-		}
+	value, err := profile.Value("VAULT_ADDR")
+	if err != nil {
+		return S, errors.New("could not find env value for vault_addr")
+	}
+	if value != "" {
+		ans.Spec.Provider.Vault.Server = value
+	}
+	value, err = profile.Value("DEFAULT_VAULT_MOUNT_POINT")
+	if err != nil {
+		return S, errors.New("could not find secret value for default_vault_mount_point")
+	}
+	if value != "" {
+		authRef.Path = value
+	}
+	value, err = profile.Value("DEFAULT_VAULT_ROLE")
+	if err != nil {
+		return S, errors.New("could not find secret value for default_vault_role")
+	}
+	if value != "" {
+		authRef.Role = value
 	}
 	ans.Spec.Provider.Vault.Auth.Kubernetes = &authRef
 	if newsecret.ObjectMeta.Name != "" {
-		secret_filename := fmt.Sprintf("%v/secret-vault-provider-%v.yaml", c.Options.OutputPath, newsecret.ObjectMeta.Name)
-		err := utils.WriteYaml(newsecret, secret_filename, c.Options.ToStdout)
+		secret_filename := utils.OutputFile(c.Options, "", fmt.Sprintf("secret-vault-provider-%v.yaml", newsecret.ObjectMeta.Name))
+		err := c.writeManifest(newsecret, secret_filename)
 		if err != nil {
 			return ans, err
 		}
@@ -220,146 +270,107 @@ func (c KesToEsoClient) InstallVaultSecrets(ctx context.Context, S api.SecretSto
 
 func (c KesToEsoClient) InstallGCPSMSecrets(ctx context.Context, S api.SecretStore) (api.SecretStore, error) {
 	ans := S
-	deployment, err := c.Client.AppsV1().Deployments(c.Options.Namespace).Get(ctx, c.Options.DeploymentName, metav1.GetOptions{})
+	profile, err := c.KESProfile(ctx)
 	if err != nil {
 		return S, err
 	}
-	containers := deployment.Spec.Template.Spec.Containers
+	kesNamespace := profile.Namespace
 	volumeName := ""
 	keyName := ""
-	for _, container := range containers {
-		if container.Name == c.Options.ContainerName {
-			mountPath := ""
-			containerEnvs := container.Env
-			for _, env := range containerEnvs {
-				if env.Name == "GOOGLE_APPLICATION_CREDENTIALS" {
-					mountPathSlice := strings.Split(env.Value, "/")
-					for idx, path := range mountPathSlice {
-						if idx == 0 {
-							mountPath = path
-						} else if idx < len(mountPathSlice)-1 {
-							mountPath = mountPath + "/" + path
-						}
-					}
-					keyName = mountPathSlice[len(mountPathSlice)-1]
-				}
-			}
-			volumeMounts := container.VolumeMounts
-			for _, mount := range volumeMounts {
-				if mount.MountPath == mountPath {
-					volumeName = mount.Name
-				}
+	mountPath := ""
+	if credentials := profile.Lookup("GOOGLE_APPLICATION_CREDENTIALS").Value; credentials != "" {
+		mountPathSlice := strings.Split(credentials, "/")
+		for idx, path := range mountPathSlice {
+			if idx == 0 {
+				mountPath = path
+			} else if idx < len(mountPathSlice)-1 {
+				mountPath = mountPath + "/" + path
 			}
 		}
+		keyName = mountPathSlice[len(mountPathSlice)-1]
+	}
+	for _, mount := range profile.Container.VolumeMounts {
+		if mount.MountPath == mountPath {
+			volumeName = mount.Name
+		}
 	}
 	var secretName string
-	volumes := deployment.Spec.Template.Spec.Volumes
-	for _, volume := range volumes {
-		if volume.Name == volumeName {
+	for _, volume := range profile.Volumes {
+		if volume.Name == volumeName && volume.Secret != nil {
 			secretName = volume.Secret.SecretName
 			ans.Spec.Provider.GCPSM.Auth.SecretRef.SecretAccessKey.Name = secretName
 			ans.Spec.Provider.GCPSM.Auth.SecretRef.SecretAccessKey.Key = keyName
-			ans.Spec.Provider.GCPSM.Auth.SecretRef.SecretAccessKey.Namespace = &c.Options.Namespace
+			ans.Spec.Provider.GCPSM.Auth.SecretRef.SecretAccessKey.Namespace = &kesNamespace
 		}
 	}
 	if secretName == "" || keyName == "" {
 		return ans, errors.New("credentials for gcp sm not found in kes deployment")
 	}
-	// if reflect.DeepEqual(ans, S) {
-	// }
 	return ans, nil
 }
 
 func (c KesToEsoClient) InstallAzureKVSecrets(ctx context.Context, S api.SecretStore) (api.SecretStore, error) {
 	ans := S
 	authRef := api.AzureKVAuth{}
-	target := c.Options
-	deployment, err := c.Client.AppsV1().Deployments(target.Namespace).Get(ctx, target.DeploymentName, metav1.GetOptions{})
+	profile, err := c.KESProfile(ctx)
 	if err != nil {
 		return S, err
 	}
+	kesNamespace := profile.Namespace
 	newsecret := &corev1.Secret{}
-	containers := deployment.Spec.Template.Spec.Containers
-	for _, container := range containers {
-		if container.Name == target.ContainerName {
-			envs := container.Env
-			for _, env := range envs {
-				if env.Name == "AZURE_TENANT_ID" {
-					if env.Value != "" {
-						svc := env.Value
-						ans.Spec.Provider.AzureKV.TenantID = &svc
-					} else if env.ValueFrom != nil {
-						key := env.ValueFrom.SecretKeyRef.Key
-						name := env.ValueFrom.SecretKeyRef.Name
-						value, err := c.GetSecretValue(ctx, name, key, target.Namespace)
-						if err != nil {
-							return S, errors.New("could not find secret value for azure_tenant_id")
-						}
-						ans.Spec.Provider.AzureKV.TenantID = &value
-					}
-				}
-				if env.Name == "AZURE_CLIENT_ID" {
-					ns := c.Options.Namespace
-					if c.Options.TargetNamespace != "" {
-						ns = c.Options.TargetNamespace
-					}
-					if env.ValueFrom != nil {
-						key := env.ValueFrom.SecretKeyRef.Key
-						name := env.ValueFrom.SecretKeyRef.Name
-						clientSelector := esmeta.SecretKeySelector{
-							Name:      name,
-							Key:       key,
-							Namespace: &ns,
-						}
-						authRef.ClientID = &clientSelector
-					} else if env.Value != "" {
-						clientSelector := esmeta.SecretKeySelector{
-							Name:      "azure-secrets",
-							Namespace: &ns,
-							Key:       "client-id",
-						}
-						newsecret, err = utils.UpdateOrCreateSecret(newsecret, &clientSelector, env.Value)
-						if err != nil {
-							return S, err
-						}
-						authRef.ClientID = &clientSelector
-					}
-				}
-				if env.Name == "AZURE_CLIENT_SECRET" {
-					ns := c.Options.Namespace
-					if c.Options.TargetNamespace != "" {
-						ns = c.Options.TargetNamespace
-					}
-					if env.ValueFrom != nil {
-						key := env.ValueFrom.SecretKeyRef.Key
-						name := env.ValueFrom.SecretKeyRef.Name
-						secretSelector := esmeta.SecretKeySelector{
-							Name:      name,
-							Key:       key,
-							Namespace: &ns,
-						}
-						authRef.ClientSecret = &secretSelector
-					} else if env.Value != "" {
-						secretSelector := esmeta.SecretKeySelector{
-							Name:      "azure-secrets",
-							Namespace: &ns,
-							Key:       "client-secrets",
-						}
-						newsecret, err = utils.UpdateOrCreateSecret(newsecret, &secretSelector, env.Value)
-						if err != nil {
-							return S, err
-						}
-						authRef.ClientSecret = &secretSelector
-					}
-
-				}
-			}
+	tenant, err := profile.Value("AZURE_TENANT_ID")
+	if err != nil {
+		return S, errors.New("could not find secret value for azure_tenant_id")
+	}
+	if tenant != "" {
+		ans.Spec.Provider.AzureKV.TenantID = &tenant
+	}
+	ns := kesNamespace
+	if c.Options.TargetNamespace != "" {
+		ns = c.Options.TargetNamespace
+	}
+	env := profile.Lookup("AZURE_CLIENT_ID")
+	if ref := env.Secret; ref != nil {
+		authRef.ClientID = &esmeta.SecretKeySelector{
+			Name:      ref.Name,
+			Key:       ref.Key,
+			Namespace: &ns,
+		}
+	} else if value := env.Value; value != "" {
+		clientSelector := esmeta.SecretKeySelector{
+			Name:      "azure-secrets",
+			Namespace: &ns,
+			Key:       "client-id",
+		}
+		newsecret, err = utils.UpdateOrCreateSecret(newsecret, &clientSelector, value)
+		if err != nil {
+			return S, err
+		}
+		authRef.ClientID = &clientSelector
+	}
+	env = profile.Lookup("AZURE_CLIENT_SECRET")
+	if ref := env.Secret; ref != nil {
+		authRef.ClientSecret = &esmeta.SecretKeySelector{
+			Name:      ref.Name,
+			Key:       ref.Key,
+			Namespace: &ns,
+		}
+	} else if value := env.Value; value != "" {
+		secretSelector := esmeta.SecretKeySelector{
+			Name:      "azure-secrets",
+			Namespace: &ns,
+			Key:       "client-secrets",
 		}
+		newsecret, err = utils.UpdateOrCreateSecret(newsecret, &secretSelector, value)
+		if err != nil {
+			return S, err
+		}
+		authRef.ClientSecret = &secretSelector
 	}
 	ans.Spec.Provider.AzureKV.AuthSecretRef = &authRef
 	if newsecret.ObjectMeta.Name != "" {
-		secret_filename := fmt.Sprintf("%v/secret-azure-provider-%v.yaml", target.OutputPath, newsecret.ObjectMeta.Name)
-		err := utils.WriteYaml(newsecret, secret_filename, target.ToStdout)
+		secret_filename := utils.OutputFile(c.Options, "", fmt.Sprintf("secret-azure-provider-%v.yaml", newsecret.ObjectMeta.Name))
+		err := c.writeManifest(newsecret, secret_filename)
 		if err != nil {
 			return ans, err
 		}
@@ -373,64 +384,46 @@ func (c KesToEsoClient) InstallAzureKVSecrets(ctx context.Context, S api.SecretS
 func (c KesToEsoClient) InstallIBMSecrets(ctx context.Context, S api.SecretStore) (api.SecretStore, error) {
 	ans := S
 	authRef := api.IBMAuth{}
-	deployment, err := c.Client.AppsV1().Deployments(c.Options.Namespace).Get(ctx, c.Options.DeploymentName, metav1.GetOptions{})
+	profile, err := c.KESProfile(ctx)
 	if err != nil {
 		return S, err
 	}
+	kesNamespace := profile.Namespace
 	newsecret := &corev1.Secret{}
-	containers := deployment.Spec.Template.Spec.Containers
-	for _, container := range containers {
-		if container.Name == c.Options.ContainerName {
-			envs := container.Env
-			for _, env := range envs {
-				if env.Name == "IBM_CLOUD_SECRETS_MANAGER_API_APIKEY" {
-					if env.Value != "" {
-						ns := c.Options.Namespace
-						if c.Options.TargetNamespace != "" {
-							ns = c.Options.TargetNamespace
-						}
-						secretSelector := esmeta.SecretKeySelector{
-							Name:      "ibm-secrets",
-							Namespace: &ns,
-							Key:       "api-key",
-						}
-						newsecret, err = utils.UpdateOrCreateSecret(newsecret, &secretSelector, env.Value)
-						if err != nil {
-							return S, err
-						}
-						authRef.SecretRef.SecretAPIKey = secretSelector
-					} else if env.ValueFrom != nil {
-						key := env.ValueFrom.SecretKeyRef.Key
-						name := env.ValueFrom.SecretKeyRef.Name
-						secretSelector := esmeta.SecretKeySelector{
-							Name:      name,
-							Key:       key,
-							Namespace: &c.Options.Namespace,
-						}
-						authRef.SecretRef.SecretAPIKey = secretSelector
-					}
-				}
-				if env.Name == "IBM_CLOUD_SECRETS_MANAGER_API_ENDPOINT" {
-					if env.ValueFrom != nil {
-						key := env.ValueFrom.SecretKeyRef.Key
-						name := env.ValueFrom.SecretKeyRef.Name
-						value, err := c.GetSecretValue(ctx, name, key, c.Options.Namespace)
-						if err != nil {
-							return S, errors.New("could not find secret value for ibm_cloud_secrets_manager_api_endpoint")
-						}
-						ans.Spec.Provider.IBM.ServiceURL = &value
-					} else if env.Value != "" {
-						svc := env.Value
-						ans.Spec.Provider.IBM.ServiceURL = &svc
-					}
-				}
-			}
+	env := profile.Lookup("IBM_CLOUD_SECRETS_MANAGER_API_APIKEY")
+	if ref := env.Secret; ref != nil {
+		authRef.SecretRef.SecretAPIKey = esmeta.SecretKeySelector{
+			Name:      ref.Name,
+			Key:       ref.Key,
+			Namespace: &kesNamespace,
+		}
+	} else if value := env.Value; value != "" {
+		ns := kesNamespace
+		if c.Options.TargetNamespace != "" {
+			ns = c.Options.TargetNamespace
 		}
+		secretSelector := esmeta.SecretKeySelector{
+			Name:      "ibm-secrets",
+			Namespace: &ns,
+			Key:       "api-key",
+		}
+		newsecret, err = utils.UpdateOrCreateSecret(newsecret, &secretSelector, value)
+		if err != nil {
+			return S, err
+		}
+		authRef.SecretRef.SecretAPIKey = secretSelector
+	}
+	endpoint, err := profile.Value("IBM_CLOUD_SECRETS_MANAGER_API_ENDPOINT")
+	if err != nil {
+		return S, errors.New("could not find secret value for ibm_cloud_secrets_manager_api_endpoint")
+	}
+	if endpoint != "" {
+		ans.Spec.Provider.IBM.ServiceURL = &endpoint
 	}
 	ans.Spec.Provider.IBM.Auth = authRef
 	if newsecret.ObjectMeta.Name != "" {
-		secret_filename := fmt.Sprintf("%v/secret-ibm-provider-%v.yaml", c.Options.OutputPath, newsecret.ObjectMeta.Name)
-		err := utils.WriteYaml(newsecret, secret_filename, c.Options.ToStdout)
+		secret_filename := utils.OutputFile(c.Options, "", fmt.Sprintf("secret-ibm-provider-%v.yaml", newsecret.ObjectMeta.Name))
+		err := c.writeManifest(newsecret, secret_filename)
 		if err != nil {
 			return ans, err
 		}
@@ -440,3 +433,141 @@ func (c KesToEsoClient) InstallIBMSecrets(ctx context.Context, S api.SecretStore
 	}
 	return ans, nil
 }
+
+var alicloudRegionRegexp = regexp.MustCompile(`^(?:https?://)?kms(?:-vpc)?\.([a-z0-9-]+)\.aliyuncs\.com`)
+
+func (c KesToEsoClient) InstallAlicloudSecrets(ctx context.Context, S api.SecretStore) (api.SecretStore, error) {
+	ans := S
+	authRef := api.AlibabaAuth{}
+	profile, err := c.KESProfile(ctx)
+	if err != nil {
+		return S, err
+	}
+	kesNamespace := profile.Namespace
+	ns := kesNamespace
+	if c.Options.TargetNamespace != "" {
+		ns = c.Options.TargetNamespace
+	}
+	newsecret := &corev1.Secret{}
+	for _, name := range []string{"ALICLOUD_ACCESS_KEY_ID", "ALICLOUD_ACCESS_KEY_SECRET"} {
+		var selector esmeta.SecretKeySelector
+		env := profile.Lookup(name)
+		if ref := env.Secret; ref != nil {
+			selector = esmeta.SecretKeySelector{
+				Name:      ref.Name,
+				Key:       ref.Key,
+				Namespace: &ns,
+			}
+		} else if value := env.Value; value != "" {
+			selector = esmeta.SecretKeySelector{
+				Name:      "alicloud-secrets",
+				Namespace: &ns,
+				Key:       strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, "ALICLOUD_"), "_", "-")),
+			}
+			newsecret, err = utils.UpdateOrCreateSecret(newsecret, &selector, value)
+			if err != nil {
+				return S, err
+			}
+		}
+		if name == "ALICLOUD_ACCESS_KEY_ID" {
+			authRef.SecretRef.AccessKeyID = selector
+		} else {
+			authRef.SecretRef.AccessKeySecret = selector
+		}
+	}
+	endpoint, err := profile.Value("ALICLOUD_ENDPOINT")
+	if err != nil {
+		return S, errors.New("could not find secret value for alicloud_endpoint")
+	}
+	if endpoint != "" {
+		ans.Spec.Provider.Alibaba.Endpoint = endpoint
+	}
+	ans.Spec.Provider.Alibaba.Auth = &authRef
+	match := alicloudRegionRegexp.FindStringSubmatch(ans.Spec.Provider.Alibaba.Endpoint)
+	if match != nil {
+		ans.Spec.Provider.Alibaba.RegionID = match[1]
+	}
+	if newsecret.ObjectMeta.Name != "" {
+		secret_filename := utils.OutputFile(c.Options, "", fmt.Sprintf("secret-alicloud-provider-%v.yaml", newsecret.ObjectMeta.Name))
+		err := c.writeManifest(newsecret, secret_filename)
+		if err != nil {
+			return ans, err
+		}
+	}
+	if authRef.SecretRef.AccessKeyID.Name == "" || authRef.SecretRef.AccessKeySecret.Name == "" {
+		return ans, errors.New("credentials for alicloud not found in kes deployment")
+	}
+	if ans.Spec.Provider.Alibaba.RegionID == "" {
+		return ans, errors.New("could not find the alicloud region from ALICLOUD_ENDPOINT in kes deployment")
+	}
+	return ans, nil
+}
+
+// InstallAkeylessSecrets fills the akeyless provider, which is not part of
+// external-secrets.io/v1alpha1 and is therefore kept aside of the SecretStore.
+func (c KesToEsoClient) InstallAkeylessSecrets(ctx context.Context, ext apis.ESOStoreExtensions) (apis.ESOStoreExtensions, error) {
+	ans := ext
+	p := apis.ESOAkeylessProvider{}
+	if ext.Akeyless != nil {
+		p = *ext.Akeyless
+	}
+	ans.Akeyless = &p
+	authRef := apis.ESOAkeylessAuth{}
+	profile, err := c.KESProfile(ctx)
+	if err != nil {
+		return ext, err
+	}
+	kesNamespace := profile.Namespace
+	ns := kesNamespace
+	if c.Options.TargetNamespace != "" {
+		ns = c.Options.TargetNamespace
+	}
+	selectors := []struct {
+		name     string
+		selector *esmeta.SecretKeySelector
+	}{
+		{"AKEYLESS_ACCESS_ID", &authRef.SecretRef.AccessID},
+		{"AKEYLESS_ACCESS_TYPE", &authRef.SecretRef.AccessType},
+		{"AKEYLESS_ACCESS_TYPE_PARAM", &authRef.SecretRef.AccessTypeParam},
+	}
+	newsecret := &corev1.Secret{}
+	for _, s := range selectors {
+		env := profile.Lookup(s.name)
+		if ref := env.Secret; ref != nil {
+			*s.selector = esmeta.SecretKeySelector{
+				Name:      ref.Name,
+				Key:       ref.Key,
+				Namespace: &ns,
+			}
+		} else if value := env.Value; value != "" {
+			*s.selector = esmeta.SecretKeySelector{
+				Name:      "akeyless-secrets",
+				Namespace: &ns,
+				Key:       strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(s.name, "AKEYLESS_"), "_", "-")),
+			}
+			newsecret, err = utils.UpdateOrCreateSecret(newsecret, s.selector, value)
+			if err != nil {
+				return ext, err
+			}
+		}
+	}
+	endpoint, err := profile.Value("AKEYLESS_API_ENDPOINT")
+	if err != nil {
+		return ext, errors.New("could not find secret value for akeyless_api_endpoint")
+	}
+	if endpoint != "" {
+		ans.Akeyless.AkeylessGWApiURL = &endpoint
+	}
+	ans.Akeyless.Auth = &authRef
+	if newsecret.ObjectMeta.Name != "" {
+		secret_filename := utils.OutputFile(c.Options, "", fmt.Sprintf("secret-akeyless-provider-%v.yaml", newsecret.ObjectMeta.Name))
+		err := c.writeManifest(newsecret, secret_filename)
+		if err != nil {
+			return ans, err
+		}
+	}
+	if authRef.SecretRef.AccessID.Name == "" || authRef.SecretRef.AccessType.Name == "" {
+		return ans, errors.New("credentials for akeyless not found in kes deployment")
+	}
+	return ans, nil
+}
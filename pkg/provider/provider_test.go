@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"kestoeso/pkg/apis"
 	"kestoeso/pkg/utils"
+	"os"
 	"reflect"
 	"testing"
 
 	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
+	"github.com/stretchr/testify/assert"
 
 	esmeta "github.com/external-secrets/external-secrets/apis/meta/v1"
 	appsv1 "k8s.io/api/apps/v1"
@@ -178,6 +180,69 @@ func TestAWSInstall(t *testing.T) {
 	}
 }
 
+func TestAWSInstallPodRole(t *testing.T) {
+	ctx := context.TODO()
+	role := "arn:aws:iam::123412341234:role/kes"
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubernetes-external-secrets", Namespace: "kes-ns"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AWSPodRoleAnnotation: role}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "kes"}}},
+		}},
+	}
+	opt := apis.KesToEsoOptions{Namespace: "kes-ns", ContainerName: "kes", DeploymentName: "kubernetes-external-secrets", ToStdout: true}
+	c := KesToEsoClient{Client: testclient.NewSimpleClientset(deployment), Options: &opt}
+	base := utils.NewSecretStore(false)
+	base.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{Service: api.AWSServiceSecretsManager}}
+	ans, err := c.InstallAWSSecrets(ctx, base)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, api.AWSAuth{}, ans.Spec.Provider.AWS.Auth)
+	assert.Equal(t, role, ans.Spec.Provider.AWS.Role)
+	assert.Equal(t, role, c.AWSPodRole(ctx))
+
+	// The role of the ExternalSecret is assumed from the pod role, as KES does.
+	base.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{Service: api.AWSServiceSecretsManager, Role: "arn:aws:iam::999999999999:role/app"}}
+	ans, err = c.InstallAWSSecrets(ctx, base)
+	assert.NoError(t, err)
+	assert.Equal(t, "arn:aws:iam::999999999999:role/app", ans.Spec.Provider.AWS.Role)
+
+	// A single literal key is of no use to the store, and is not written.
+	deployment.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "AWS_ACCESS_KEY_ID", Value: "AKIA"}}
+	output := t.TempDir()
+	opt.ToStdout = false
+	opt.OutputPath = output
+	c = KesToEsoClient{Client: testclient.NewSimpleClientset(deployment), Options: &opt}
+	base.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{Service: api.AWSServiceSecretsManager}}
+	ans, err = c.InstallAWSSecrets(ctx, base)
+	assert.NoError(t, err)
+	assert.Equal(t, api.AWSAuth{}, ans.Spec.Provider.AWS.Auth)
+	assert.Equal(t, role, ans.Spec.Provider.AWS.Role)
+	written, err := os.ReadDir(output)
+	assert.NoError(t, err)
+	assert.Empty(t, written)
+}
+
+func TestAWSInstallMissingCredentials(t *testing.T) {
+	ctx := context.TODO()
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubernetes-external-secrets", Namespace: "kes-ns"},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "kes"}}},
+		}},
+	}
+	opt := apis.KesToEsoOptions{Namespace: "kes-ns", ContainerName: "kes", DeploymentName: "kubernetes-external-secrets", ToStdout: true}
+	c := KesToEsoClient{Client: testclient.NewSimpleClientset(deployment), Options: &opt}
+	base := utils.NewSecretStore(false)
+	base.Spec.Provider = &api.SecretStoreProvider{AWS: &api.AWSProvider{Service: api.AWSServiceSecretsManager}}
+	ans, err := c.InstallAWSSecrets(ctx, base)
+	assert.Error(t, err)
+	// no secretRef without a name or key is left behind
+	assert.Equal(t, api.AWSAuth{}, ans.Spec.Provider.AWS.Auth)
+	assert.Equal(t, api.AWSAuth{}, base.Spec.Provider.AWS.Auth)
+}
+
 func TestGCPInstall(t *testing.T) {
 	ctx := context.TODO()
 	deploymentWithSecretRef := appsv1.Deployment{
@@ -490,3 +555,144 @@ func TestVaultInstall(t *testing.T) {
 		t.Errorf("want %v got %s", want_url, got_url)
 	}
 }
+
+func TestAlicloudInstall(t *testing.T) {
+	ctx := context.TODO()
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubernetes-external-secrets",
+			Namespace: "kes-ns",
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "kes",
+							Env: []corev1.EnvVar{
+								{
+									Name:  "ALICLOUD_ENDPOINT",
+									Value: "https://kms.eu-central-1.aliyuncs.com",
+								},
+								{
+									Name:  "ALICLOUD_ACCESS_KEY_ID",
+									Value: "id",
+								},
+								{
+									Name: "ALICLOUD_ACCESS_KEY_SECRET",
+									ValueFrom: &corev1.EnvVarSource{
+										SecretKeyRef: &corev1.SecretKeySelector{
+											LocalObjectReference: corev1.LocalObjectReference{
+												Name: "alicloud-credentials",
+											},
+											Key: "secret",
+										},
+									}},
+							}},
+					},
+				},
+			},
+		},
+	}
+	base := utils.NewSecretStore(false)
+	prov := api.SecretStoreProvider{}
+	prov.Alibaba = &api.AlibabaProvider{}
+	base.Spec.Provider = &prov
+	c := KesToEsoClient{
+		Client: testclient.NewSimpleClientset(&deployment),
+		Options: &apis.KesToEsoOptions{
+			Namespace:      "kes-ns",
+			ContainerName:  "kes",
+			DeploymentName: "kubernetes-external-secrets",
+			ToStdout:       true,
+		},
+	}
+	ans, err := c.InstallAlicloudSecrets(ctx, base)
+	if err != nil {
+		t.Errorf("want success got %v", err)
+	}
+	ns := "kes-ns"
+	want := api.AlibabaProvider{
+		Endpoint: "https://kms.eu-central-1.aliyuncs.com",
+		RegionID: "eu-central-1",
+		Auth: &api.AlibabaAuth{
+			SecretRef: api.AlibabaAuthSecretRef{
+				AccessKeyID:     esmeta.SecretKeySelector{Name: "alicloud-secrets", Namespace: &ns, Key: "access-key-id"},
+				AccessKeySecret: esmeta.SecretKeySelector{Name: "alicloud-credentials", Namespace: &ns, Key: "secret"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(want, *ans.Spec.Provider.Alibaba) {
+		t.Errorf("want %v got %v", want, *ans.Spec.Provider.Alibaba)
+	}
+}
+
+func TestAkeylessInstall(t *testing.T) {
+	ctx := context.TODO()
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubernetes-external-secrets",
+			Namespace: "kes-ns",
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "kes",
+							Env: []corev1.EnvVar{
+								{
+									Name:  "AKEYLESS_API_ENDPOINT",
+									Value: "https://api.akeyless.io",
+								},
+								{
+									Name:  "AKEYLESS_ACCESS_ID",
+									Value: "p-123456",
+								},
+								{
+									Name:  "AKEYLESS_ACCESS_TYPE",
+									Value: "access_key",
+								},
+								{
+									Name: "AKEYLESS_ACCESS_TYPE_PARAM",
+									ValueFrom: &corev1.EnvVarSource{
+										SecretKeyRef: &corev1.SecretKeySelector{
+											LocalObjectReference: corev1.LocalObjectReference{
+												Name: "akeyless-credentials",
+											},
+											Key: "access-key",
+										},
+									}},
+							}},
+					},
+				},
+			},
+		},
+	}
+	c := KesToEsoClient{
+		Client: testclient.NewSimpleClientset(&deployment),
+		Options: &apis.KesToEsoOptions{
+			Namespace:      "kes-ns",
+			ContainerName:  "kes",
+			DeploymentName: "kubernetes-external-secrets",
+			ToStdout:       true,
+		},
+	}
+	ans, err := c.InstallAkeylessSecrets(ctx, apis.ESOStoreExtensions{})
+	if err != nil {
+		t.Errorf("want success got %v", err)
+	}
+	ns := "kes-ns"
+	url := "https://api.akeyless.io"
+	want := apis.ESOAkeylessProvider{
+		AkeylessGWApiURL: &url,
+		Auth: &apis.ESOAkeylessAuth{
+			SecretRef: apis.ESOAkeylessAuthSecretRef{
+				AccessID:        esmeta.SecretKeySelector{Name: "akeyless-secrets", Namespace: &ns, Key: "access-id"},
+				AccessType:      esmeta.SecretKeySelector{Name: "akeyless-secrets", Namespace: &ns, Key: "access-type"},
+				AccessTypeParam: esmeta.SecretKeySelector{Name: "akeyless-credentials", Namespace: &ns, Key: "access-key"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(want, *ans.Akeyless) {
+		t.Errorf("want %v got %v", want, *ans.Akeyless)
+	}
+}
@@ -0,0 +1,225 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	yaml "sigs.k8s.io/yaml"
+)
+
+// Code identifies a kind of warning. Codes are stable across releases, so
+// pipelines can gate on them.
+type Code string
+
+const (
+	CodeProviderCredentials Code = "provider-credentials" // backend credentials could not be read from KES
+	CodeUnsupportedBackend  Code = "unsupported-backend"
+	CodeNoStore             Code = "no-store"            // no store can be built, the ExternalSecret is not written
+	CodeStoreNameTemplate   Code = "store-name-template" // the naming template failed, the default name is used
+	CodeStoreNameTaken      Code = "store-name-taken"
+	CodeStoreNearMatch      Code = "store-near-match" // an existing store almost matches a generated one
+	CodeUnknownInstance     Code = "unknown-instance" // no KES deployment has the controllerId of the ExternalSecret
+	CodeVersionIgnored      Code = "version-ignored"
+	CodeVersionConflict     Code = "version-conflict"
+	CodeBinaryTemplated     Code = "binary-templated"
+	CodeStoreSplit          Code = "store-split" // one ExternalSecret per key vault or project
+	CodeTemplateSplit       Code = "template-split"
+	CodePathKeyIgnored      Code = "path-key-ignored"
+	CodePathRecursive       Code = "path-recursive"
+	CodeRenderedV1beta1     Code = "rendered-v1beta1"
+	CodeFieldDropped        Code = "field-dropped" // the ESO API version written has no such field
+	CodeTemplateSkipped     Code = "template-skipped"
+	CodeInstanceDiscovery   Code = "instance-discovery"
+	CodeKESDetection        Code = "kes-detection" // the KES workload could not be found, or several were
+	CodeAWSPodRole          Code = "aws-pod-role"  // ESO pods need the kube2iam or kiam annotation of KES pods
+	CodeStoreLoad           Code = "store-load"
+	CodeKustomization       Code = "kustomization"
+	CodeHelmChart           Code = "helm-chart"
+	CodeHelmCredentials     Code = "helm-credentials" // a credential Secret is left out of the chart
+	CodeKESEnv              Code = "kes-env"          // an envFrom source of the KES container could not be read
+)
+
+// Status of a converted document or file.
+type Status string
+
+const (
+	StatusConverted Status = "converted"
+	StatusWarnings  Status = "converted-with-warnings"
+	StatusSkipped   Status = "skipped" // not a KES ExternalSecret
+	StatusFailed    Status = "failed"
+)
+
+// severity orders statuses, so a file gets the worst status of its documents.
+var severity = map[Status]int{
+	StatusConverted: 0,
+	StatusSkipped:   1,
+	StatusWarnings:  2,
+	StatusFailed:    3,
+}
+
+type Warning struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// Log records warnings, along with the KES features that were left out of
+// the generated files. Every entry is logged as well. A nil Log only logs.
+type Log struct {
+	Warnings []Warning `json:"warnings,omitempty"`
+	Skipped  []string  `json:"skipped,omitempty"`
+}
+
+func (l *Log) Warnf(code Code, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.WithField("code", code).Warn(message)
+	if l != nil {
+		l.Warnings = append(l.Warnings, Warning{Code: code, Message: message})
+	}
+}
+
+// Skipf records a warning about feature, which is missing from the output.
+func (l *Log) Skipf(code Code, feature string, format string, args ...interface{}) {
+	l.Warnf(code, format, args...)
+	if l != nil {
+		l.Skipped = append(l.Skipped, feature)
+	}
+}
+
+// Object is a generated manifest.
+type Object struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+	Path       string `json:"path,omitempty"` // empty when written to stdout
+}
+
+// StoreBinding tells which store an ExternalSecret reads from.
+type StoreBinding struct {
+	ExternalSecret string `json:"externalSecret"`
+	Kind           string `json:"kind"`
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace,omitempty"`
+	Created        bool   `json:"created"`
+	Source         string `json:"source,omitempty"` // where a reused store was loaded from
+}
+
+// VaultKey is what tells Vault stores apart, see parser.VaultStoreKey.
+type VaultKey struct {
+	Server    string `json:"server,omitempty"`
+	AuthMount string `json:"authMount,omitempty"`
+	Role      string `json:"role,omitempty"`
+	KVMount   string `json:"kvMount,omitempty"`
+	KVVersion string `json:"kvVersion,omitempty"`
+}
+
+// Store is a store the ExternalSecrets of the run are bound to.
+type Store struct {
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace,omitempty"`
+	Source    string    `json:"source,omitempty"` // where a reused store was loaded from
+	Vault     *VaultKey `json:"vault,omitempty"`
+	Users     []string  `json:"users"` // KES ExternalSecrets sharing the store, as namespace/name
+}
+
+// Document is the conversion of a single KES ExternalSecret.
+type Document struct {
+	Index    int            `json:"index"`
+	Name     string         `json:"name,omitempty"` // namespace/name of the KES ExternalSecret
+	Status   Status         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Objects  []Object       `json:"objects,omitempty"`
+	Bindings []StoreBinding `json:"bindings,omitempty"`
+	Log
+}
+
+// Fail marks the document as failed.
+func (d *Document) Fail(err error) {
+	d.Status = StatusFailed
+	d.Error = err.Error()
+}
+
+// Done sets the status of a document that didn't fail.
+func (d *Document) Done() {
+	if d.Status != "" {
+		return
+	}
+	d.Status = StatusConverted
+	if len(d.Warnings) > 0 {
+		d.Status = StatusWarnings
+	}
+}
+
+// File is the conversion of an input file, or of an ExternalSecret read
+// from the cluster.
+type File struct {
+	Path      string     `json:"path"`
+	Status    Status     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Documents []Document `json:"documents,omitempty"`
+}
+
+type Summary struct {
+	Files     int `json:"files"`
+	Documents int `json:"documents"`
+	Converted int `json:"converted"`
+	Warnings  int `json:"warnings"` // documents converted with warnings
+	Skipped   int `json:"skipped"`
+	Failed    int `json:"failed"`
+}
+
+// Report describes a whole generate run. Warnings of the run itself, such
+// as failing to read existing stores, are kept at the top level.
+type Report struct {
+	Summary Summary `json:"summary"`
+	Files   []File  `json:"files"`
+	Stores  []Store `json:"stores,omitempty"`
+	Log
+}
+
+// AddFile adds a file made of docs, or a file that could not be read when
+// err is set.
+func (r *Report) AddFile(path string, docs []Document, err error) {
+	file := File{Path: path, Status: StatusConverted, Documents: docs}
+	if err != nil {
+		file.Status = StatusFailed
+		file.Error = err.Error()
+	}
+	for _, doc := range docs {
+		if severity[doc.Status] > severity[file.Status] {
+			file.Status = doc.Status
+		}
+		switch doc.Status {
+		case StatusConverted:
+			r.Summary.Converted++
+		case StatusWarnings:
+			r.Summary.Warnings++
+		case StatusSkipped:
+			r.Summary.Skipped++
+		case StatusFailed:
+			r.Summary.Failed++
+		}
+	}
+	r.Summary.Files++
+	r.Summary.Documents += len(docs)
+	r.Files = append(r.Files, file)
+}
+
+// Write saves the report as JSON when path ends in .json, as YAML otherwise.
+func (r Report) Write(path string) error {
+	var dat []byte
+	var err error
+	if filepath.Ext(path) == ".json" {
+		dat, err = json.MarshalIndent(r, "", "  ")
+	} else {
+		dat, err = yaml.Marshal(r)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, dat, 0644)
+}
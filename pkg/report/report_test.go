@@ -0,0 +1,76 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "sigs.k8s.io/yaml"
+)
+
+func TestLog(t *testing.T) {
+	var none *Log
+	none.Warnf(CodeStoreSplit, "only logged")
+	none.Skipf(CodeTemplateSkipped, "template.data.a", "only logged")
+
+	l := Log{}
+	l.Warnf(CodeStoreSplit, "split %v", "app")
+	l.Skipf(CodeTemplateSkipped, "template.data.a", "skipping %v", "a")
+	assert.Equal(t, []Warning{
+		{Code: CodeStoreSplit, Message: "split app"},
+		{Code: CodeTemplateSkipped, Message: "skipping a"},
+	}, l.Warnings)
+	assert.Equal(t, []string{"template.data.a"}, l.Skipped)
+}
+
+func TestDocumentStatus(t *testing.T) {
+	doc := Document{}
+	doc.Done()
+	assert.Equal(t, StatusConverted, doc.Status)
+
+	doc = Document{}
+	doc.Warnf(CodeStoreSplit, "split")
+	doc.Done()
+	assert.Equal(t, StatusWarnings, doc.Status)
+
+	doc = Document{}
+	doc.Fail(errors.New("boom"))
+	doc.Done()
+	assert.Equal(t, StatusFailed, doc.Status)
+	assert.Equal(t, "boom", doc.Error)
+}
+
+func TestReport(t *testing.T) {
+	r := Report{}
+	r.AddFile("a.yaml", []Document{{Status: StatusConverted}, {Status: StatusWarnings}}, nil)
+	r.AddFile("b.yaml", []Document{{Status: StatusSkipped}, {Status: StatusFailed}}, nil)
+	r.AddFile("c.yaml", nil, errors.New("not yaml"))
+	r.Warnf(CodeStoreLoad, "no cluster")
+	r.Stores = []Store{{Kind: "ClusterSecretStore", Name: "vault", Vault: &VaultKey{Server: "https://vault:8200", KVMount: "secret"}, Users: []string{"default/a", "default/b"}}}
+	assert.Equal(t, Summary{Files: 3, Documents: 4, Converted: 1, Warnings: 1, Skipped: 1, Failed: 1}, r.Summary)
+	statuses := []Status{}
+	for _, file := range r.Files {
+		statuses = append(statuses, file.Status)
+	}
+	assert.Equal(t, []Status{StatusWarnings, StatusFailed, StatusFailed}, statuses)
+
+	dir := t.TempDir()
+	for _, name := range []string{"report.json", "report.yaml"} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, r.Write(path))
+		dat, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		got := Report{}
+		if name == "report.json" {
+			assert.NoError(t, json.Unmarshal(dat, &got))
+		} else {
+			assert.NoError(t, yaml.Unmarshal(dat, &got))
+		}
+		assert.Equal(t, r, got)
+		assert.Contains(t, string(dat), "store-load")
+		assert.Contains(t, string(dat), "kvMount")
+	}
+}
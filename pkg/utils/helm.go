@@ -0,0 +1,350 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "sigs.k8s.io/yaml"
+)
+
+// HelmTemplatesDir holds, in the helm layout, the generated manifests.
+const HelmTemplatesDir = "templates"
+
+// helmTemplateHeader starts every manifest already turned into a template,
+// so later runs only convert the files they added.
+const helmTemplateHeader = "# Generated by kes-to-eso. Values are read from values.yaml.\n"
+
+// DefaultRefreshInterval is the refresh interval ESO uses when none is set.
+const DefaultRefreshInterval = "1h"
+
+// Chart is the Chart.yaml written by kestoeso.
+type Chart struct {
+	APIVersion  string `json:"apiVersion"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Version     string `json:"version"`
+}
+
+var helmValueLine = regexp.MustCompile(`(?m)^( *)([^ :][^:]*): kestoeso-value-([0-9]+)$`)
+
+// helmValue is a field of a manifest read from the values.
+type helmValue struct {
+	path []string // path of the field in the manifest
+	expr string   // template expression of the value
+	// block is set for maps, which are inlined with toYaml.
+	block bool
+}
+
+// WriteHelmChart turns the manifests written to the templates directory of
+// outputPath into a chart. Namespaces, store names, store auth and refresh
+// intervals are read from values.yaml. Credential Secrets holding static
+// credentials are left out, the stores reading Secrets the values name,
+// unless credentialValues copies their data into values.yaml as well. It
+// returns the credential Secrets left out, as namespace/name. Values and a
+// Chart.yaml from an earlier run are kept, so the chart can be generated in
+// several batches and edited.
+func WriteHelmChart(outputPath string, chartName string, credentialValues bool) ([]string, error) {
+	chartFile := filepath.Join(outputPath, "Chart.yaml")
+	if _, err := os.Stat(chartFile); os.IsNotExist(err) {
+		chart := Chart{
+			APIVersion:  "v2",
+			Name:        chartName,
+			Description: "external-secrets objects migrated from kubernetes-external-secrets",
+			Type:        "application",
+			Version:     "0.1.0",
+		}
+		err = WriteYaml(chart, chartFile, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	valuesFile := filepath.Join(outputPath, "values.yaml")
+	values := map[string]interface{}{}
+	dat, err := os.ReadFile(valuesFile)
+	if err == nil {
+		err = yaml.Unmarshal(dat, &values)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %v: %w", valuesFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	templatesDir := filepath.Join(outputPath, HelmTemplatesDir)
+	entries, err := os.ReadDir(templatesDir)
+	if err != nil {
+		return nil, err
+	}
+	objects := map[string]map[string]interface{}{}
+	leftOut := make([]string, 0)
+	generated := map[string]interface{}{
+		"refreshInterval": DefaultRefreshInterval,
+		"namespaces":      map[string]interface{}{},
+		"stores":          map[string]interface{}{},
+		"externalSecrets": map[string]interface{}{},
+	}
+	if credentialValues {
+		generated["credentials"] = map[string]interface{}{}
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+		path := filepath.Join(templatesDir, entry.Name())
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(string(dat), helmTemplateHeader) {
+			continue
+		}
+		obj := map[string]interface{}{}
+		err = yaml.Unmarshal(dat, &obj)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %v: %w", path, err)
+		}
+		if kind, _ := obj["kind"].(string); kind == "Secret" && !credentialValues {
+			// values.yaml is meant to be committed, static
+			// credentials don't belong there
+			metadata, _ := obj["metadata"].(map[string]interface{})
+			leftOut = append(leftOut, fmt.Sprintf("%v/%v", metadata["namespace"], metadata["name"]))
+			err = os.Remove(path)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		objects[path] = obj
+		addHelmValues(generated, obj)
+	}
+	values = mergeValues(values, generated)
+	for path, obj := range objects {
+		tpl, err := helmTemplate(obj, values)
+		if err != nil {
+			return nil, fmt.Errorf("could not template %v: %w", path, err)
+		}
+		err = os.WriteFile(path, []byte(tpl), 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return leftOut, WriteYaml(values, valuesFile, false)
+}
+
+// storeKey is the key of a store in the values: its name for a
+// ClusterSecretStore, namespace/name for a SecretStore.
+func storeKey(kind string, namespace string, name string) string {
+	if kind == "SecretStore" {
+		return namespace + "/" + name
+	}
+	return name
+}
+
+// isAuthField tells whether a provider field is lifted into the store values.
+func isAuthField(field string) bool {
+	return strings.HasPrefix(field, "auth") || field == "role"
+}
+
+// storeProvider returns the name and fields of the provider of a store.
+func storeProvider(obj map[string]interface{}) (string, map[string]interface{}) {
+	spec, _ := obj["spec"].(map[string]interface{})
+	providers, _ := spec["provider"].(map[string]interface{})
+	for name, fields := range providers {
+		if fields, ok := fields.(map[string]interface{}); ok {
+			return name, fields
+		}
+	}
+	return "", nil
+}
+
+func isStore(kind string) bool {
+	return kind == "SecretStore" || kind == "ClusterSecretStore"
+}
+
+// addHelmValues adds to values the values of a manifest.
+func addHelmValues(values map[string]interface{}, obj map[string]interface{}) {
+	kind, _ := obj["kind"].(string)
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	namespace, _ := metadata["namespace"].(string)
+	if namespace != "" {
+		values["namespaces"].(map[string]interface{})[namespace] = namespace
+	}
+	switch {
+	case isStore(kind):
+		store := map[string]interface{}{"name": name}
+		_, fields := storeProvider(obj)
+		for field, value := range fields {
+			if isAuthField(field) {
+				store[field] = value
+			}
+		}
+		values["stores"].(map[string]interface{})[storeKey(kind, namespace, name)] = store
+	case kind == "Secret":
+		credentials := map[string]interface{}{}
+		for _, field := range secretDataFields {
+			data, _ := obj[field].(map[string]interface{})
+			for key, value := range data {
+				credentials[key] = value
+			}
+		}
+		values["credentials"].(map[string]interface{})[namespace+"/"+name] = credentials
+	case kind == "ExternalSecret":
+		externalSecrets := values["externalSecrets"].(map[string]interface{})
+		if externalSecrets[namespace] == nil {
+			externalSecrets[namespace] = map[string]interface{}{}
+		}
+		es := map[string]interface{}{}
+		spec, _ := obj["spec"].(map[string]interface{})
+		if interval, ok := spec["refreshInterval"].(string); ok && interval != "" {
+			es["refreshInterval"] = interval
+		}
+		externalSecrets[namespace].(map[string]interface{})[name] = es
+	}
+}
+
+// secretDataFields are the fields of a credential Secret read from the
+// credentials values, so that each environment can supply its own.
+var secretDataFields = []string{"data", "stringData"}
+
+// mergeValues adds to values the generated ones it misses. Values already
+// set are kept.
+func mergeValues(values map[string]interface{}, generated map[string]interface{}) map[string]interface{} {
+	for key, value := range generated {
+		current, ok := values[key]
+		if !ok {
+			values[key] = value
+			continue
+		}
+		currentMap, ok := current.(map[string]interface{})
+		generatedMap, isMap := value.(map[string]interface{})
+		if ok && isMap {
+			values[key] = mergeValues(currentMap, generatedMap)
+		}
+	}
+	return values
+}
+
+// helmIndex is a template expression reading keys from .Values.
+func helmIndex(keys ...string) string {
+	quoted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		quoted = append(quoted, strconv.Quote(key))
+	}
+	return "index .Values " + strings.Join(quoted, " ")
+}
+
+// helmTemplate renders a manifest as a template reading from values.
+func helmTemplate(obj map[string]interface{}, values map[string]interface{}) (string, error) {
+	kind, _ := obj["kind"].(string)
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	namespace, _ := metadata["namespace"].(string)
+	fields := []helmValue{}
+	if namespace != "" {
+		fields = append(fields, helmValue{
+			path: []string{"metadata", "namespace"},
+			expr: helmIndex("namespaces", namespace),
+		})
+	}
+	stores, _ := values["stores"].(map[string]interface{})
+	switch {
+	case isStore(kind):
+		key := storeKey(kind, namespace, name)
+		fields = append(fields, helmValue{
+			path: []string{"metadata", "name"},
+			expr: helmIndex("stores", key, "name"),
+		})
+		provider, providerFields := storeProvider(obj)
+		authFields := make([]string, 0)
+		for field := range providerFields {
+			if isAuthField(field) {
+				authFields = append(authFields, field)
+			}
+		}
+		sort.Strings(authFields)
+		for _, field := range authFields {
+			_, isMap := providerFields[field].(map[string]interface{})
+			fields = append(fields, helmValue{
+				path:  []string{"spec", "provider", provider, field},
+				expr:  helmIndex("stores", key, field),
+				block: isMap,
+			})
+		}
+	case kind == "Secret":
+		for _, field := range secretDataFields {
+			data, _ := obj[field].(map[string]interface{})
+			keys := make([]string, 0, len(data))
+			for key := range data {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fields = append(fields, helmValue{
+					path: []string{field, key},
+					expr: helmIndex("credentials", namespace+"/"+name, key),
+				})
+			}
+		}
+	case kind == "ExternalSecret":
+		fields = append(fields, helmValue{
+			path: []string{"spec", "refreshInterval"},
+			expr: helmIndex("externalSecrets", namespace, name, "refreshInterval") + " | default .Values.refreshInterval",
+		})
+		spec, _ := obj["spec"].(map[string]interface{})
+		ref, _ := spec["secretStoreRef"].(map[string]interface{})
+		refKind, _ := ref["kind"].(string)
+		refName, _ := ref["name"].(string)
+		if refKind == "" {
+			refKind = "SecretStore"
+		}
+		key := storeKey(refKind, namespace, refName)
+		if _, ok := stores[key]; ok {
+			fields = append(fields, helmValue{
+				path: []string{"spec", "secretStoreRef", "name"},
+				expr: helmIndex("stores", key, "name"),
+			})
+		}
+	}
+	for i, field := range fields {
+		parent := obj
+		for _, key := range field.path[:len(field.path)-1] {
+			child, ok := parent[key].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				parent[key] = child
+			}
+			parent = child
+		}
+		parent[field.path[len(field.path)-1]] = fmt.Sprintf("kestoeso-value-%d", i)
+	}
+	dat, err := yaml.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	// ESO templates use the same delimiters as helm.
+	tpl := strings.ReplaceAll(string(dat), "{{", `{{ "{{" }}`)
+	var missing error
+	tpl = helmValueLine.ReplaceAllStringFunc(tpl, func(line string) string {
+		match := helmValueLine.FindStringSubmatch(line)
+		i, _ := strconv.Atoi(match[3])
+		if i >= len(fields) {
+			missing = fmt.Errorf("unexpected value %v", line)
+			return line
+		}
+		field := fields[i]
+		if field.block {
+			return fmt.Sprintf("%v%v: {{- toYaml (%v) | nindent %d }}", match[1], match[2], field.expr, len(match[1])+2)
+		}
+		return fmt.Sprintf("%v%v: {{ %v | quote }}", match[1], match[2], field.expr)
+	})
+	if missing != nil {
+		return "", missing
+	}
+	return helmTemplateHeader + tpl, nil
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"fmt"
+	"kestoeso/pkg/apis"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	yaml "sigs.k8s.io/yaml"
+)
+
+// StoresDir holds, in the kustomize layout, the objects that don't belong
+// to a single namespace: ClusterSecretStores and the provider credentials.
+const StoresDir = "stores"
+
+const kustomizationFile = "kustomization.yaml"
+
+// Kustomization is the part of a kustomization.yaml written by kestoeso.
+type Kustomization struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Resources  []string `json:"resources,omitempty"`
+	Components []string `json:"components,omitempty"`
+}
+
+// OutputFile returns where the file holding an object of namespace goes.
+// The flat layout puts every file in the output directory, and the helm
+// layout in the templates directory of the chart. The kustomize layout uses a
+// directory per namespace, and StoresDir for objects with an empty namespace.
+func OutputFile(options *apis.KesToEsoOptions, namespace string, filename string) string {
+	switch options.OutputLayout {
+	case apis.OutputLayoutKustomize:
+		dir := namespace
+		if dir == "" {
+			dir = StoresDir
+		}
+		return filepath.Join(options.OutputPath, dir, filename)
+	case apis.OutputLayoutHelm:
+		return filepath.Join(options.OutputPath, HelmTemplatesDir, filename)
+	default:
+		return filepath.Join(options.OutputPath, filename)
+	}
+}
+
+// ObjectFile returns where the object name of namespace goes, in a file named
+// after prefix. The flat and helm layouts keep the objects of every namespace
+// in a single directory, so with NamespaceFileNames their file names hold the
+// namespace as well.
+func ObjectFile(options *apis.KesToEsoOptions, namespace string, prefix string, name string) string {
+	filename := fmt.Sprintf("%v-%v.yaml", prefix, name)
+	if namespace != "" && options.NamespaceFileNames && options.OutputLayout != apis.OutputLayoutKustomize {
+		filename = fmt.Sprintf("%v-%v-%v.yaml", prefix, namespace, name)
+	}
+	return OutputFile(options, namespace, filename)
+}
+
+// WriteKustomizations writes a kustomization.yaml in every directory of the
+// kustomize layout, listing the files kestoeso wrote there, and one in the
+// output directory listing those directories. Files from earlier runs are listed as
+// well, so the output can be generated in several batches. StoresDir becomes
+// a kustomize component when storesComponent is set.
+func WriteKustomizations(outputPath string, storesComponent bool) error {
+	entries, err := os.ReadDir(outputPath)
+	if err != nil {
+		return err
+	}
+	root := Kustomization{APIVersion: "kustomize.config.k8s.io/v1beta1", Kind: "Kustomization"}
+	for _, entry := range entries {
+		// Other directories, such as overlays, are not ours to list.
+		if !entry.IsDir() || (entry.Name() != StoresDir && len(validation.IsDNS1123Label(entry.Name())) > 0) {
+			continue
+		}
+		dir := filepath.Join(outputPath, entry.Name())
+		kustomization := Kustomization{APIVersion: "kustomize.config.k8s.io/v1beta1", Kind: "Kustomization"}
+		isComponent := entry.Name() == StoresDir && storesComponent
+		if isComponent {
+			kustomization = Kustomization{APIVersion: "kustomize.config.k8s.io/v1alpha1", Kind: "Component"}
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() || !isGeneratedFile(file.Name()) {
+				continue
+			}
+			kustomization.Resources = append(kustomization.Resources, file.Name())
+		}
+		if len(kustomization.Resources) == 0 {
+			continue
+		}
+		err = writeKustomization(dir, kustomization)
+		if err != nil {
+			return err
+		}
+		if isComponent {
+			root.Components = append(root.Components, entry.Name())
+		} else {
+			root.Resources = append(root.Resources, entry.Name())
+		}
+	}
+	return writeKustomization(outputPath, root)
+}
+
+// generatedFilePrefixes start the names of the files kestoeso writes.
+var generatedFilePrefixes = []string{"external-secret-", "secret-store-", "secret-"}
+
+func isGeneratedFile(name string) bool {
+	if !strings.HasSuffix(name, ".yaml") {
+		return false
+	}
+	for _, prefix := range generatedFilePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeKustomization(dir string, kustomization Kustomization) error {
+	sort.Strings(kustomization.Resources)
+	dat, err := yaml.Marshal(kustomization)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, kustomizationFile), dat, 0644)
+}
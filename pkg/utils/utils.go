@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"kestoeso/pkg/apis"
 	"os"
+	"path/filepath"
+	"sync"
 
 	api "github.com/external-secrets/external-secrets/apis/externalsecrets/v1alpha1"
 	esmeta "github.com/external-secrets/external-secrets/apis/meta/v1"
@@ -30,7 +32,7 @@ func NewSecretStore(secretStore bool) api.SecretStore {
 	return d
 }
 
-func WriteYaml(S interface{}, filepath string, to_stdout bool) error {
+func WriteYaml(S interface{}, filename string, to_stdout bool) error {
 	dat, err := yaml.Marshal(S)
 	if err != nil {
 		return err
@@ -39,7 +41,11 @@ func WriteYaml(S interface{}, filepath string, to_stdout bool) error {
 		fmt.Println(string(dat))
 		NewYaml()
 	} else {
-		err = os.WriteFile(filepath, dat, 0644)
+		err = os.MkdirAll(filepath.Dir(filename), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filename, dat, 0644)
 		if err != nil {
 			return err
 		}
@@ -66,3 +72,35 @@ func UpdateOrCreateSecret(secret *corev1.Secret, essecret *esmeta.SecretKeySelec
 func NewYaml() {
 	fmt.Println("---")
 }
+
+// ManifestBuffer keeps manifests to be written later with WriteYaml, so
+// that documents converted concurrently write their files in a stable order.
+type ManifestBuffer struct {
+	mu        sync.Mutex
+	manifests []bufferedManifest
+}
+
+type bufferedManifest struct {
+	obj      interface{}
+	filename string
+}
+
+func (b *ManifestBuffer) Add(obj interface{}, filename string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.manifests = append(b.manifests, bufferedManifest{obj: obj, filename: filename})
+}
+
+// Flush writes the manifests in the order they were added.
+func (b *ManifestBuffer) Flush(toStdout bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, manifest := range b.manifests {
+		err := WriteYaml(manifest.obj, manifest.filename, toStdout)
+		if err != nil {
+			return err
+		}
+	}
+	b.manifests = nil
+	return nil
+}